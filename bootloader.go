@@ -0,0 +1,145 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "github.com/jackc/pgx/v4"
+    "log"
+    "net"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// bootConfig is the JSON body of POST /bootloader/configure, the sections of
+// conf/boot.toml the bootloader sets up.  Without Bundles, the bootloader's
+// own are kept.
+type bootConfig struct {
+    Database Database
+    AquametaUser AquametaUser
+    HTTPServer HTTPServer
+    PGFS PGFS
+    Bundles *Bundles
+}
+
+// configureResponse is the JSON reply to /bootloader/configure.
+type configureResponse struct {
+    Status int `json:"status"`
+    Message string `json:"message"`
+    Problems []string `json:"problems,omitempty"`
+    URL string `json:"url,omitempty"`      // where the server will be once restarted
+}
+
+// configure handles POST /bootloader/configure: it validates the posted
+// settings, with overrides applied the way they will be when the server
+// restarts, then writes them as posted to bootConfigFile.  It returns whether
+// it did.  current is the bootloader's own config, whose ports are about to be
+// freed.
+func configure(w http.ResponseWriter, req *http.Request, current tomlConfig, bootConfigFile string, overrides func(*tomlConfig) error) bool {
+    var config tomlConfig
+
+    if req.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        writeConfigureResponse(w, configureResponse{Status: http.StatusMethodNotAllowed, Message: http.StatusText(http.StatusMethodNotAllowed)})
+        return false
+    }
+
+    var body bootConfig
+    if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+        writeConfigureResponse(w, configureResponse{Status: http.StatusBadRequest, Message: "Malformed configuration: " + err.Error()})
+        return false
+    }
+    config.Database = body.Database
+    config.AquametaUser = body.AquametaUser
+    config.HTTPServer = body.HTTPServer
+    config.PGFS = body.PGFS
+    config.Bundles = current.Bundles
+    if body.Bundles != nil {
+        config.Bundles = *body.Bundles
+    }
+
+    resolved := config
+    if err := overrides(&resolved); err != nil {
+        writeConfigureResponse(w, configureResponse{Status: http.StatusBadRequest, Message: "Invalid configuration override " + err.Error()})
+        return false
+    }
+    if problems := validateBootConfig(resolved, current); len(problems) > 0 {
+        writeConfigureResponse(w, configureResponse{Status: http.StatusBadRequest, Message: "Invalid configuration", Problems: problems})
+        return false
+    }
+
+    if err := writeConfig(bootConfigFile, config); err != nil {
+        log.Printf("Unable to write %s: %v", bootConfigFile, err)
+        writeConfigureResponse(w, configureResponse{Status: http.StatusInternalServerError, Message: "Unable to write " + bootConfigFile})
+        return false
+    }
+    log.Printf("Wrote boot configuration to %s", bootConfigFile)
+
+    writeConfigureResponse(w, configureResponse{
+        Status: http.StatusOK,
+        Message: "Configuration written, restarting",
+        URL: resolved.HTTPServer.Protocol + "://" + resolved.HTTPServer.IP + ":" + resolved.HTTPServer.Port + resolved.HTTPServer.StartupURL,
+    })
+    return true
+}
+
+func writeConfigureResponse(w http.ResponseWriter, response configureResponse) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(response.Status)
+    json.NewEncoder(w).Encode(response)
+}
+
+// validateBootConfig checks the config with validateConfig, then that the
+// server could actually start with it: a standalone database has to accept a
+// connection, and the ports have to be free.  It returns every problem it finds.
+func validateBootConfig(config tomlConfig, current tomlConfig) []string {
+    problems := validateConfig(config)
+    if len(problems) > 0 {
+        return problems
+    }
+    problem := func(format string, v ...interface{}) {
+        problems = append(problems, fmt.Sprintf(format, v...))
+    }
+
+    db := config.Database
+    if db.Mode == "standalone" {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        conn, err := pgx.Connect(ctx, connectionString(config))
+        cancel()
+        if err != nil {
+            problem("Unable to connect to database %s on %s:%d as %s: %v", db.DatabaseName, db.Host, db.Port, db.Role, err)
+        } else {
+            conn.Close(context.Background())
+        }
+    } else if db.listenAddresses() != "" {
+        // an embedded server only listening on its unix socket needs no port;
+        // the bootloader's own embedded server is stopped before the restart
+        addr := db.Host + ":" + strconv.Itoa(int(db.Port))
+        currentAddr := current.Database.Host + ":" + strconv.Itoa(int(current.Database.Port))
+        if !(current.Database.Mode == "embedded" && addr == currentAddr) {
+            if err := portFree(addr); err != nil {
+                problem("Database port %s is not available: %v", addr, err)
+            }
+        }
+    }
+
+    // the bootloader's own port is freed before the restart
+    addr := config.HTTPServer.IP + ":" + config.HTTPServer.Port
+    if addr != current.HTTPServer.IP+":"+current.HTTPServer.Port {
+        if err := portFree(addr); err != nil {
+            problem("HTTP port %s is not available: %v", addr, err)
+        }
+    }
+
+    return problems
+}
+
+// portFree checks that nothing is listening on addr by briefly listening on it.
+func portFree(addr string) error {
+    l, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    return l.Close()
+}
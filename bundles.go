@@ -0,0 +1,114 @@
+package main
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+// readBundle finds <name>.json in the configured bundle sources, searching them
+// in order, and returns its contents along with where it was found.  A source
+// is either a directory or a .zip, .tar.gz or .tgz archive.
+func readBundle(sources []string, name string) ([]byte, string, error) {
+    fileName := name + ".json"
+
+    for _, source := range sources {
+        var content []byte
+        var err error
+
+        switch {
+        case strings.HasSuffix(source, ".zip"):
+            content, err = readZipEntry(source, fileName)
+        case strings.HasSuffix(source, ".tar.gz"), strings.HasSuffix(source, ".tgz"):
+            content, err = readTarEntry(source, fileName)
+        default:
+            content, err = ioutil.ReadFile(filepath.Join(source, fileName))
+        }
+
+        if err == nil {
+            return content, filepath.Join(source, fileName), nil
+        }
+        if !os.IsNotExist(err) {
+            return nil, "", fmt.Errorf("%s: %v", source, err)
+        }
+    }
+
+    return nil, "", fmt.Errorf("bundle %s not found in %s", name, strings.Join(sources, ", "))
+}
+
+// readZipEntry returns the first file in the archive whose base name is
+// fileName, or an os.ErrNotExist error.
+func readZipEntry(archive string, fileName string) ([]byte, error) {
+    r, err := zip.OpenReader(archive)
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+
+    for _, f := range r.File {
+        if path.Base(f.Name) != fileName {
+            continue
+        }
+        rc, err := f.Open()
+        if err != nil {
+            return nil, err
+        }
+        defer rc.Close()
+        return ioutil.ReadAll(rc)
+    }
+    return nil, os.ErrNotExist
+}
+
+// readTarEntry is readZipEntry for gzipped tar archives.
+func readTarEntry(archive string, fileName string) ([]byte, error) {
+    f, err := os.Open(archive)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    gz, err := gzip.NewReader(f)
+    if err != nil {
+        return nil, err
+    }
+    defer gz.Close()
+
+    tr := tar.NewReader(gz)
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            return nil, os.ErrNotExist
+        }
+        if err != nil {
+            return nil, err
+        }
+        if header.Typeflag == tar.TypeReg && path.Base(header.Name) == fileName {
+            return ioutil.ReadAll(tr)
+        }
+    }
+}
+
+// bundleFile is the part of an exported bundle .json file the server reads.
+type bundleFile struct {
+    Repository struct {
+        Name string `json:"name"`
+        HeadCommitID string `json:"head_commit_id"`
+    } `json:"repository"`
+    Commits []struct {
+        ID string `json:"id"`
+    } `json:"commits"`
+}
+
+func parseBundleFile(content []byte) (bundleFile, error) {
+    var bundle bundleFile
+    err := json.Unmarshal(content, &bundle)
+    return bundle, err
+}
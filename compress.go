@@ -0,0 +1,380 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "container/list"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// encoderWriter compresses what's written to it in one Content-Encoding, and
+// can be reused for another response with Reset.
+type encoderWriter interface {
+    io.WriteCloser
+    Reset(w io.Writer)
+}
+
+// the Content-Encodings this server can produce, by name.  gzip is always
+// built in; see compress_brotli.go for br.
+var encoders = map[string]func() encoderWriter{
+    "gzip": func() encoderWriter { return gzip.NewWriter(nil) },
+}
+
+// the encodings to offer when HTTPServer.Compression.Encodings isn't set, in
+// order of preference
+var defaultEncodings = []string{"gzip"}
+
+// the mimetypes compressed when HTTPServer.Compression.Mimetypes isn't set
+var defaultCompressMimetypes = []string{
+    "text/*",
+    "application/javascript",
+    "application/x-javascript",
+    "application/json",
+    "application/xml",
+    "application/xhtml+xml",
+    "application/wasm",
+    "image/svg+xml",
+}
+
+// the HTTPServer.Compression sizes when none are configured
+const defaultCompressMinSize = 1024
+const defaultCompressCacheSize = 32 << 20
+
+// compressor negotiates and applies response compression.
+type compressor struct {
+    enabled bool
+    encodings []string
+    mimetypes []string
+    minSize int
+    pools map[string]*sync.Pool
+    cache *compressedCache
+}
+
+func newCompressor(config Compression) *compressor {
+    c := &compressor{
+        enabled: !config.Disabled,
+        encodings: config.Encodings,
+        mimetypes: config.Mimetypes,
+        minSize: config.MinSize,
+        pools: make(map[string]*sync.Pool),
+    }
+    if len(c.encodings) == 0 {
+        c.encodings = defaultEncodings
+    }
+    if len(c.mimetypes) == 0 {
+        c.mimetypes = defaultCompressMimetypes
+    }
+    if c.minSize == 0 {
+        c.minSize = defaultCompressMinSize
+    }
+    cacheSize := config.CacheSize
+    if cacheSize == 0 {
+        cacheSize = defaultCompressCacheSize
+    }
+    if cacheSize > 0 {
+        c.cache = newCompressedCache(cacheSize)
+    }
+    for _, name := range c.encodings {
+        newWriter := encoders[name]
+        c.pools[name] = &sync.Pool{New: func() interface{} { return newWriter() }}
+    }
+    return c
+}
+
+// compressible reports whether responses of mimetype are compressed.
+func (c *compressor) compressible(mimetype string) bool {
+    if !c.enabled {
+        return false
+    }
+    mimetype = strings.ToLower(strings.TrimSpace(strings.SplitN(mimetype, ";", 2)[0]))
+    for _, pattern := range c.mimetypes {
+        pattern = strings.ToLower(pattern)
+        if strings.HasSuffix(pattern, "*") {
+            if strings.HasPrefix(mimetype, strings.TrimSuffix(pattern, "*")) {
+                return true
+            }
+        } else if mimetype == pattern {
+            return true
+        }
+    }
+    return false
+}
+
+// negotiate picks the encoding to send a response of mimetype in, or "" to
+// send it as is.
+func (c *compressor) negotiate(req *http.Request, mimetype string) string {
+    if !c.compressible(mimetype) {
+        return ""
+    }
+    accepted := acceptedEncodings(req.Header.Get("Accept-Encoding"))
+    for _, name := range c.encodings {
+        q, ok := accepted[name]
+        if !ok {
+            q, ok = accepted["*"]
+        }
+        if ok && q > 0 {
+            return name
+        }
+    }
+    return ""
+}
+
+// acceptedEncodings parses Accept-Encoding into each coding's q value.
+func acceptedEncodings(header string) map[string]float64 {
+    accepted := make(map[string]float64)
+    for _, part := range strings.Split(header, ",") {
+        params := strings.Split(part, ";")
+        name := strings.ToLower(strings.TrimSpace(params[0]))
+        if name == "" {
+            continue
+        }
+        q := 1.0
+        for _, param := range params[1:] {
+            param = strings.TrimSpace(param)
+            if strings.HasPrefix(param, "q=") {
+                if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+                    q = v
+                }
+            }
+        }
+        accepted[name] = q
+    }
+    return accepted
+}
+
+// compress encodes content whole, for the precompressed cache.
+func (c *compressor) compress(encoding string, content []byte) ([]byte, error) {
+    var b bytes.Buffer
+    enc := c.pools[encoding].Get().(encoderWriter)
+    defer c.pools[encoding].Put(enc)
+    enc.Reset(&b)
+    if _, err := enc.Write(content); err != nil {
+        return nil, err
+    }
+    if err := enc.Close(); err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+// precompressed returns content compressed in encoding, from the cache when
+// key (which has to change whenever the content does) is already there.
+func (c *compressor) precompressed(key string, encoding string, load func() ([]byte, error)) ([]byte, error) {
+    key += "-" + encoding
+    if c.cache != nil {
+        if compressed, ok := c.cache.get(key); ok {
+            return compressed, nil
+        }
+    }
+    content, err := load()
+    if err != nil {
+        return nil, err
+    }
+    compressed, err := c.compress(encoding, content)
+    if err != nil {
+        return nil, err
+    }
+    if c.cache != nil {
+        c.cache.add(key, compressed)
+    }
+    return compressed, nil
+}
+
+// handler compresses next's responses on the fly.  Responses that are already
+// encoded, have an ETag (whoever made them chose the representation it names),
+// are partial, or are smaller than MinSize are sent as they are.
+func (c *compressor) handler(next http.HandlerFunc) http.HandlerFunc {
+    if !c.enabled {
+        return next
+    }
+    return func(w http.ResponseWriter, req *http.Request) {
+        cw := &compressWriter{ResponseWriter: w, compressor: c, req: req}
+        defer cw.close()
+        next(cw, req)
+    }
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// to compress it.
+type compressWriter struct {
+    http.ResponseWriter
+    compressor *compressor
+    req *http.Request
+
+    status int
+    decided bool
+    buffer []byte
+    encoding string
+    pool *sync.Pool
+    encoder encoderWriter
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+    if cw.status == 0 {
+        cw.status = status
+    }
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+    if cw.status == 0 {
+        cw.status = http.StatusOK
+    }
+    if !cw.decided {
+        // once eligible, encoding is set and the rest is buffered too
+        if cw.encoding == "" && !cw.eligible() {
+            cw.start("")
+        } else {
+            cw.buffer = append(cw.buffer, p...)
+            if len(cw.buffer) < cw.compressor.minSize {
+                return len(p), nil
+            }
+            cw.start(cw.encoding)
+            buffered := cw.buffer
+            cw.buffer = nil
+            if _, err := cw.encoder.Write(buffered); err != nil {
+                return 0, err
+            }
+            return len(p), nil
+        }
+    }
+    if cw.encoder != nil {
+        return cw.encoder.Write(p)
+    }
+    return cw.ResponseWriter.Write(p)
+}
+
+// eligible decides whether the response could be compressed, and in what.
+func (cw *compressWriter) eligible() bool {
+    h := cw.Header()
+    if cw.status < 200 || cw.status == http.StatusNoContent || cw.status == http.StatusPartialContent || cw.status >= 300 && cw.status < 400 {
+        return false
+    }
+    if h.Get("Content-Encoding") != "" || h.Get("ETag") != "" || h.Get("Content-Range") != "" {
+        return false
+    }
+    if cw.req.Method == http.MethodHead {
+        return false
+    }
+    if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil && length < cw.compressor.minSize {
+        return false
+    }
+    mimetype := h.Get("Content-Type")
+    if cw.compressor.compressible(mimetype) {
+        h.Add("Vary", "Accept-Encoding")
+    }
+    cw.encoding = cw.compressor.negotiate(cw.req, mimetype)
+    return cw.encoding != ""
+}
+
+// start sends the header, and starts compressing if encoding isn't "".
+func (cw *compressWriter) start(encoding string) {
+    cw.decided = true
+    if encoding != "" {
+        h := cw.Header()
+        h.Del("Content-Length")
+        h.Set("Content-Encoding", encoding)
+        cw.pool = cw.compressor.pools[encoding]
+        cw.encoder = cw.pool.Get().(encoderWriter)
+        cw.encoder.Reset(cw.ResponseWriter)
+    }
+    cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// close sends whatever is still held back, uncompressed if it never reached
+// MinSize, and finishes the encoding.
+func (cw *compressWriter) close() {
+    if !cw.decided {
+        if cw.status == 0 {
+            return
+        }
+        cw.start("")
+        if len(cw.buffer) > 0 {
+            cw.ResponseWriter.Write(cw.buffer)
+        }
+        return
+    }
+    if cw.encoder != nil {
+        cw.encoder.Close()
+        cw.pool.Put(cw.encoder)
+        cw.encoder = nil
+    }
+}
+
+// Flush sends what's been written so far, compressed or not.
+func (cw *compressWriter) Flush() {
+    if !cw.decided && cw.status != 0 {
+        buffered := cw.buffer
+        cw.buffer = nil
+        cw.start("")
+        cw.ResponseWriter.Write(buffered)
+    }
+    if f, ok := cw.encoder.(interface{ Flush() error }); ok {
+        f.Flush()
+    }
+    if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+        return h.Hijack()
+    }
+    return nil, nil, http.ErrNotSupported
+}
+
+// compressedCache keeps the most recently used precompressed content, up to
+// size bytes.
+type compressedCache struct {
+    mu sync.Mutex
+    size int
+    used int
+    entries map[string]*list.Element
+    order *list.List
+}
+
+type compressedEntry struct {
+    key string
+    content []byte
+}
+
+func newCompressedCache(size int) *compressedCache {
+    return &compressedCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (cc *compressedCache) get(key string) ([]byte, bool) {
+    cc.mu.Lock()
+    defer cc.mu.Unlock()
+    e, ok := cc.entries[key]
+    if !ok {
+        return nil, false
+    }
+    cc.order.MoveToFront(e)
+    return e.Value.(*compressedEntry).content, true
+}
+
+func (cc *compressedCache) add(key string, content []byte) {
+    if len(content) > cc.size {
+        return
+    }
+    cc.mu.Lock()
+    defer cc.mu.Unlock()
+    if _, ok := cc.entries[key]; ok {
+        return
+    }
+    cc.entries[key] = cc.order.PushFront(&compressedEntry{key, content})
+    cc.used += len(content)
+    for cc.used > cc.size {
+        oldest := cc.order.Back()
+        entry := oldest.Value.(*compressedEntry)
+        cc.order.Remove(oldest)
+        delete(cc.entries, entry.key)
+        cc.used -= len(entry.content)
+    }
+}
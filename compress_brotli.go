@@ -0,0 +1,20 @@
+//go:build brotli
+package main
+
+// Brotli support needs github.com/andybalholm/brotli, which the default build
+// leaves out:
+//
+//     go get github.com/andybalholm/brotli
+//     go build -tags brotli
+//
+// It's then preferred over gzip unless HTTPServer.Compression.Encodings says
+// otherwise.
+
+import (
+    "github.com/andybalholm/brotli"
+)
+
+func init() {
+    encoders["br"] = func() encoderWriter { return brotli.NewWriterLevel(nil, brotli.DefaultCompression) }
+    defaultEncodings = append([]string{"br"}, defaultEncodings...)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestAcceptedEncodings(t *testing.T) {
+    tests := []struct {
+        header string
+        want map[string]float64
+    }{
+        {"", map[string]float64{}},
+        {"gzip", map[string]float64{"gzip": 1}},
+        {"gzip, deflate, br", map[string]float64{"gzip": 1, "deflate": 1, "br": 1}},
+        {"br;q=1.0, GZIP;q=0.5, *;q=0", map[string]float64{"br": 1, "gzip": 0.5, "*": 0}},
+        {"gzip; q=0.8; foo=bar", map[string]float64{"gzip": 0.8}},
+        {"gzip;q=high, ,identity", map[string]float64{"gzip": 1, "identity": 1}},
+    }
+    for _, test := range tests {
+        if got := acceptedEncodings(test.header); !reflect.DeepEqual(got, test.want) {
+            t.Errorf("acceptedEncodings(%q) = %v, want %v", test.header, got, test.want)
+        }
+    }
+}
+
+func TestNegotiate(t *testing.T) {
+    c := newCompressor(Compression{})
+    tests := []struct {
+        acceptEncoding string
+        mimetype string
+        want string
+    }{
+        {"gzip", "text/html; charset=utf-8", "gzip"},
+        {"*", "application/json", "gzip"},
+        {"gzip;q=0", "text/css", ""},
+        {"*;q=0", "text/css", ""},
+        {"br", "text/css", ""},
+        {"", "text/css", ""},
+        {"gzip", "image/png", ""},
+    }
+    for _, test := range tests {
+        req := httptest.NewRequest("GET", "/", nil)
+        req.Header.Set("Accept-Encoding", test.acceptEncoding)
+        if got := c.negotiate(req, test.mimetype); got != test.want {
+            t.Errorf("negotiate(%q, %q) = %q, want %q", test.acceptEncoding, test.mimetype, got, test.want)
+        }
+    }
+
+    disabled := newCompressor(Compression{Disabled: true})
+    req := httptest.NewRequest("GET", "/", nil)
+    req.Header.Set("Accept-Encoding", "gzip")
+    if got := disabled.negotiate(req, "text/html"); got != "" {
+        t.Errorf("disabled compressor negotiated %q", got)
+    }
+}
+
+func TestCompressWriter(t *testing.T) {
+    large := strings.Repeat("<p>Hello, world</p>\n", 200)
+    small := "not found"
+
+    tests := []struct {
+        name string
+        method string
+        header map[string]string
+        status int
+        body string
+        writes int          // how many Writes the body is sent in
+        compressed bool
+    }{
+        {name: "large text", header: map[string]string{"Content-Type": "text/html"}, body: large, compressed: true},
+        {name: "large text in small writes", header: map[string]string{"Content-Type": "text/html"}, body: large, writes: 100, compressed: true},
+        {name: "large 404", header: map[string]string{"Content-Type": "text/html"}, status: http.StatusNotFound, body: large, compressed: true},
+        {name: "small 404", header: map[string]string{"Content-Type": "text/plain"}, status: http.StatusNotFound, body: small},
+        {name: "below MinSize", header: map[string]string{"Content-Type": "text/html"}, body: large[:1000], writes: 10},
+        {name: "Content-Length below MinSize", header: map[string]string{"Content-Type": "text/html", "Content-Length": "1000"}, body: large[:1000]},
+        {name: "not compressible", header: map[string]string{"Content-Type": "image/png"}, body: large},
+        {name: "already encoded", header: map[string]string{"Content-Type": "text/html", "Content-Encoding": "gzip"}, body: large},
+        {name: "ETag", header: map[string]string{"Content-Type": "text/html", "ETag": `"1-2"`}, body: large},
+        {name: "not modified", header: map[string]string{"Content-Type": "text/html"}, status: http.StatusNotModified},
+        {name: "no content", status: http.StatusNoContent},
+        {name: "partial", header: map[string]string{"Content-Type": "text/html", "Content-Range": "bytes 0-3999/8000"}, status: http.StatusPartialContent, body: large},
+        {name: "HEAD", method: http.MethodHead, header: map[string]string{"Content-Type": "text/html", "Content-Length": "4000"}},
+    }
+    c := newCompressor(Compression{CacheSize: -1})
+    for _, test := range tests {
+        handler := c.handler(func(w http.ResponseWriter, req *http.Request) {
+            for name, value := range test.header {
+                w.Header().Set(name, value)
+            }
+            if test.status != 0 {
+                w.WriteHeader(test.status)
+            }
+            writes := test.writes
+            if writes == 0 {
+                writes = 1
+            }
+            body := []byte(test.body)
+            size := (len(body) + writes - 1) / writes
+            for len(body) > 0 {
+                n := size
+                if n > len(body) {
+                    n = len(body)
+                }
+                if _, err := w.Write(body[:n]); err != nil {
+                    t.Fatalf("%s: %v", test.name, err)
+                }
+                body = body[n:]
+            }
+        })
+
+        method := test.method
+        if method == "" {
+            method = http.MethodGet
+        }
+        req := httptest.NewRequest(method, "/", nil)
+        req.Header.Set("Accept-Encoding", "gzip")
+        w := httptest.NewRecorder()
+        handler(w, req)
+
+        status := test.status
+        if status == 0 {
+            status = http.StatusOK
+        }
+        if w.Code != status {
+            t.Errorf("%s: status %d, want %d", test.name, w.Code, status)
+        }
+
+        body := w.Body.Bytes()
+        encoding := w.Header().Get("Content-Encoding")
+        if test.compressed {
+            if encoding != "gzip" {
+                t.Errorf("%s: Content-Encoding %q, want gzip", test.name, encoding)
+                continue
+            }
+            if length := w.Header().Get("Content-Length"); length != "" {
+                t.Errorf("%s: compressed with Content-Length %s", test.name, length)
+            }
+            r, err := gzip.NewReader(bytes.NewReader(body))
+            if err != nil {
+                t.Errorf("%s: %v", test.name, err)
+                continue
+            }
+            if body, err = ioutil.ReadAll(r); err != nil {
+                t.Errorf("%s: %v", test.name, err)
+                continue
+            }
+        } else if encoding != test.header["Content-Encoding"] {
+            t.Errorf("%s: Content-Encoding %q, want %q", test.name, encoding, test.header["Content-Encoding"])
+        }
+        if string(body) != test.body {
+            t.Errorf("%s: body of %d bytes, want %d", test.name, len(body), len(test.body))
+        }
+
+        vary := w.Header().Get("Vary") == "Accept-Encoding"
+        if test.compressed && !vary {
+            t.Errorf("%s: compressed without Vary: Accept-Encoding", test.name)
+        }
+    }
+}
+
+func TestCompressWriterFlush(t *testing.T) {
+    c := newCompressor(Compression{})
+    handler := c.handler(func(w http.ResponseWriter, req *http.Request) {
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Write([]byte("data: 1\n\n"))
+        // a stream can't wait for MinSize
+        w.(http.Flusher).Flush()
+        w.Write([]byte("data: 2\n\n"))
+    })
+    req := httptest.NewRequest("GET", "/", nil)
+    req.Header.Set("Accept-Encoding", "gzip")
+    w := httptest.NewRecorder()
+    handler(w, req)
+
+    if !w.Flushed {
+        t.Error("not flushed")
+    }
+    if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+        t.Errorf("Content-Encoding %q, want none", encoding)
+    }
+    if body := w.Body.String(); body != "data: 1\n\ndata: 2\n\n" {
+        t.Errorf("body %q", body)
+    }
+}
+
+func TestCompressedCache(t *testing.T) {
+    cache := newCompressedCache(10)
+    cache.add("a", []byte("aaaa"))
+    cache.add("b", []byte("bbbb"))
+    cache.get("a")
+    // evicts b, the least recently used
+    cache.add("c", []byte("cccc"))
+    // too big to cache at all
+    cache.add("d", []byte(strconv.Itoa(1<<40)))
+
+    for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": false} {
+        if _, ok := cache.get(key); ok != want {
+            t.Errorf("%s cached: %v, want %v", key, ok, want)
+        }
+    }
+    if cache.used != 8 {
+        t.Errorf("%d bytes used, want 8", cache.used)
+    }
+}
@@ -1,7 +1,16 @@
 package main
 
 import (
+    "fmt"
     "github.com/BurntSushi/toml"
+    embeddedPostgres "github.com/aquametalabs/embedded-postgres"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strconv"
+    "time"
 )
 
 type tomlConfig struct {
@@ -9,16 +18,173 @@ type tomlConfig struct {
     AquametaUser AquametaUser `toml:"AquametaUser"`
     HTTPServer HTTPServer `toml:"HTTPServer"`
     PGFS PGFS `toml:"PGFS"`
+    Bundles Bundles `toml:"Bundles"`
 }
 
 type Database struct {
     Mode string
     Role string
     Password string
+    PasswordFile string `toml:",omitempty"`     // read Password from this file instead
     Host string
     Port uint32
     DatabaseName string
     EmbeddedPostgresRuntimePath string
+
+    // connection
+    SocketDirectory string `toml:",omitempty"`     // connect over the unix socket in this directory instead of Host
+    Auth string `toml:",omitempty"`                // password (the default), peer or cert
+    SSLMode string `toml:",omitempty"`             // disable, allow, prefer, require, verify-ca or verify-full
+    SSLCert string `toml:",omitempty"`             // client certificate, for cert auth
+    SSLKey string `toml:",omitempty"`
+    SSLRootCert string `toml:",omitempty"`         // CA certificate, for verify-ca and verify-full
+
+    // embedded only
+    ListenAddresses string `toml:",omitempty"`     // TCP addresses to listen on besides the socket, none by default
+    Version string `toml:",omitempty"`             // PostgreSQL major version, e.g. "12"
+    StartTimeout string `toml:",omitempty"`        // e.g. "45s"
+    Locale string `toml:",omitempty"`              // initdb's locale, e.g. "en_US.UTF-8"
+    Encoding string `toml:",omitempty"`            // the database's encoding, e.g. "UTF8"
+    SharedBuffers string `toml:",omitempty"`       // e.g. "128MB"
+    MaxConnections int `toml:",omitempty"`
+    ServerSettings map[string]interface{} `toml:",omitempty"`    // any other postgresql.conf parameters
+
+    Settings map[string]interface{} `toml:",omitempty"`  // session settings for every connection, e.g. lock_timeout = "10s"
+    Debug bool `toml:",omitempty"`                        // log every statement
+
+    Pool Pool
+}
+
+// the Database.Settings every connection gets unless configured otherwise,
+// so a stuck request can't hold locks forever
+var defaultSessionSettings = map[string]string{
+    "idle_in_transaction_session_timeout": "60s",
+    "lock_timeout": "10s",
+}
+
+// sessionSettings returns the settings to `set` on every new connection: the
+// defaults, then Database.Settings, then statement logging if Debug is on.
+func (d Database) sessionSettings() map[string]string {
+    settings := make(map[string]string)
+    for name, value := range defaultSessionSettings {
+        settings[name] = value
+    }
+    for name, value := range d.Settings {
+        settings[name] = fmt.Sprint(value)
+    }
+    if d.Debug {
+        settings["log_statement"] = "all"
+        settings["log_min_messages"] = "notice"
+    }
+    return settings
+}
+
+// Connection pools.  HTTP requests, socket.io events and PGFS each get a pool
+// of their own, so a slow `ls` of a huge table through PGFS can't take every
+// connection the web server has.  Durations are like "30s"; zero values leave
+// pgx's defaults.
+type Pool struct {
+    MaxConns int32 `toml:",omitempty"`           // HTTP requests
+    MinConns int32 `toml:",omitempty"`           // idle connections kept open
+    MaxConnLifetime string `toml:",omitempty"`
+    MaxConnIdleTime string `toml:",omitempty"`
+    HealthCheckPeriod string `toml:",omitempty"`
+    StatementTimeout string `toml:",omitempty"`  // for HTTP requests, "0" for none
+    EventsMaxConns int32 `toml:",omitempty"`     // socket.io events, two of which are held for LISTEN
+    PGFSMaxConns int32 `toml:",omitempty"`
+    PGFSStatementTimeout string `toml:",omitempty"`
+}
+
+// the Pool sizes for events and PGFS when none are configured
+const defaultEventsMaxConns = 3
+const defaultPGFSMaxConns = 2
+
+// the Pool statement timeouts when none are configured
+const defaultStatementTimeout = "30s"
+const defaultPGFSStatementTimeout = "60s"
+
+// auth returns how to authenticate: password, peer or cert.
+func (d Database) auth() string {
+    if d.Auth == "" {
+        return "password"
+    }
+    return d.Auth
+}
+
+// listenAddresses returns the embedded server's listen_addresses.  Windows
+// has no unix sockets, so there it listens on localhost.
+func (d Database) listenAddresses() string {
+    if d.ListenAddresses == "" && runtime.GOOS == "windows" {
+        return "localhost"
+    }
+    return d.ListenAddresses
+}
+
+// socketDirectory returns the absolute directory of the unix socket to
+// connect through, or "" to connect over TCP.  The embedded server's socket
+// is in the runtime directory unless it listens on TCP.
+func (d Database) socketDirectory() string {
+    dir := d.SocketDirectory
+    if dir == "" && d.Mode == "embedded" && d.listenAddresses() == "" {
+        dir = filepath.Join(d.EmbeddedPostgresRuntimePath, "socket")
+    }
+    if dir == "" {
+        return ""
+    }
+    if abs, err := filepath.Abs(dir); err == nil {
+        return abs
+    }
+    return dir
+}
+
+// the embedded PostgreSQL major versions, by Database.Version
+var embeddedVersions = map[string]embeddedPostgres.PostgresVersion{
+    "13": embeddedPostgres.V13,
+    "12": embeddedPostgres.V12,
+    "11": embeddedPostgres.V11,
+    "10": embeddedPostgres.V10,
+    "9.6": embeddedPostgres.V9,
+}
+
+// the Database.Version and Database.StartTimeout when none are configured
+const defaultEmbeddedVersion = "12"
+const defaultStartTimeout = 45 * time.Second
+
+// embeddedVersion returns the embedded PostgreSQL version to install.
+func (d Database) embeddedVersion() (embeddedPostgres.PostgresVersion, error) {
+    if d.Version == "" {
+        return embeddedVersions[defaultEmbeddedVersion], nil
+    }
+    version, ok := embeddedVersions[d.Version]
+    if !ok {
+        return "", fmt.Errorf("Database.Version is %q, expected one of 13, 12, 11, 10 or 9.6", d.Version)
+    }
+    return version, nil
+}
+
+// startTimeout parses StartTimeout, falling back to the default.
+func (d Database) startTimeout() time.Duration {
+    timeout, err := time.ParseDuration(d.StartTimeout)
+    if err != nil {
+        return defaultStartTimeout
+    }
+    return timeout
+}
+
+// serverSettings returns the postgresql.conf parameters to set on the embedded
+// server, SharedBuffers and MaxConnections included.
+func (d Database) serverSettings() map[string]string {
+    settings := make(map[string]string)
+    for name, value := range d.ServerSettings {
+        settings[name] = fmt.Sprint(value)
+    }
+    if d.SharedBuffers != "" {
+        settings["shared_buffers"] = d.SharedBuffers
+    }
+    if d.MaxConnections != 0 {
+        settings["max_connections"] = strconv.Itoa(d.MaxConnections)
+    }
+    return settings
 }
 
 type AquametaUser struct {
@@ -34,6 +200,37 @@ type HTTPServer struct {
     SSLCertificateFile string
     SSLKeyFile string
     StartupURL string
+    ShutdownTimeout string      // how long to wait for in-flight requests on shutdown, e.g. "30s"
+
+    Compression Compression
+}
+
+// Response compression, negotiated with Accept-Encoding.  Mimetypes match
+// exactly, or by prefix when they end in "*", like "text/*".  endpoint.resource
+// content is compressed once and cached; everything else is compressed as it's
+// sent.
+type Compression struct {
+    Disabled bool `toml:",omitempty"`
+    Encodings []string `toml:",omitempty"`   // in order of preference, from gzip and (built with -tags brotli) br
+    Mimetypes []string `toml:",omitempty"`   // defaults to defaultCompressMimetypes
+    MinSize int `toml:",omitempty"`          // bytes; smaller responses aren't worth compressing
+    CacheSize int `toml:",omitempty"`        // bytes of precompressed endpoint.resource content to keep, -1 for none
+}
+
+// the HTTPServer.ShutdownTimeout when none is configured
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdownTimeout parses ShutdownTimeout, falling back to the default.
+func (h HTTPServer) shutdownTimeout() time.Duration {
+    if h.ShutdownTimeout == "" {
+        return defaultShutdownTimeout
+    }
+    timeout, err := time.ParseDuration(h.ShutdownTimeout)
+    if err != nil {
+        log.Printf("Invalid HTTPServer.ShutdownTimeout %q, using %s: %v", h.ShutdownTimeout, defaultShutdownTimeout, err)
+        return defaultShutdownTimeout
+    }
+    return timeout
 }
 
 
@@ -42,6 +239,65 @@ type PGFS struct {
     MountDirectory string
 }
 
+// Bundles imported at install time
+type Bundles struct {
+    Sources []string      // directories, .zip or .tar.gz archives of bundle .json files, searched in order
+    Bundle []Bundle
+}
+
+type Bundle struct {
+    Name string
+    Checkout *bool        // defaults to true
+}
+
+// checkout reports whether the bundle should be checked out after import.
+func (b Bundle) checkout() bool {
+    return b.Checkout == nil || *b.Checkout
+}
+
+// the bundles installed when the config doesn't list any
+var defaultBundles = [...]string{
+    "org.aquameta.core.mimetypes",
+    "org.aquameta.core.endpoint",
+    "org.aquameta.core.widget",
+    "org.aquameta.core.ide",
+    "org.aquameta.core.semantics",
+    "org.aquameta.ui.fsm",
+    "org.aquameta.ui.layout",
+    "org.aquameta.ui.tags",
+    "org.aquameta.core.bootloader",
+    // "org.aquameta.core.repository",
+}
+
+// bundles returns the configured bundles, or the default core bundles.
+func (c tomlConfig) bundles() []Bundle {
+    if len(c.Bundles.Bundle) > 0 {
+        return c.Bundles.Bundle
+    }
+    bundles := make([]Bundle, len(defaultBundles))
+    for i, name := range defaultBundles {
+        bundles[i] = Bundle{Name: name}
+    }
+    return bundles
+}
+
+// bundleSources returns the configured bundle sources, relative paths resolved
+// against the working directory, defaulting to bundles/.
+func (c tomlConfig) bundleSources(workingDirectory string) []string {
+    if len(c.Bundles.Sources) == 0 {
+        return []string{filepath.Join(workingDirectory, "bundles")}
+    }
+    sources := make([]string, len(c.Bundles.Sources))
+    for i, source := range c.Bundles.Sources {
+        if filepath.IsAbs(source) {
+            sources[i] = source
+        } else {
+            sources[i] = filepath.Join(workingDirectory, source)
+        }
+    }
+    return sources
+}
+
 
 func getConfig(configFile string) (tomlConfig, error) {
     var config tomlConfig
@@ -51,3 +307,248 @@ func getConfig(configFile string) (tomlConfig, error) {
 
     return config, nil
 }
+
+// writeConfig writes config to configFile atomically: it's written to a temp
+// file next to it, synced, then renamed over it, so a reader sees either the
+// old file or the whole new one.
+func writeConfig(configFile string, config tomlConfig) error {
+    dir := filepath.Dir(configFile)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+
+    f, err := ioutil.TempFile(dir, "."+filepath.Base(configFile)+".*")
+    if err != nil {
+        return err
+    }
+    // a no-op once the rename has happened
+    defer os.Remove(f.Name())
+
+    // it holds the database password
+    if err := f.Chmod(0600); err != nil {
+        f.Close()
+        return err
+    }
+    if _, err := f.WriteString("# Boot Configuration, written by the bootloader\n\n"); err != nil {
+        f.Close()
+        return err
+    }
+    if err := toml.NewEncoder(f).Encode(config); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    return os.Rename(f.Name(), configFile)
+}
+
+// validateConfig checks the config for everything that can be checked without
+// starting anything: settings that are required or have to be one of a few
+// values, ports, and the files and directories the server will need.  It
+// returns every problem it finds, each saying which setting to fix.
+func validateConfig(config tomlConfig) []string {
+    var problems []string
+    problem := func(format string, v ...interface{}) {
+        problems = append(problems, fmt.Sprintf(format, v...))
+    }
+
+    //
+    // Database
+    //
+    db := config.Database
+    switch db.Mode {
+    case "embedded":
+        if db.EmbeddedPostgresRuntimePath == "" {
+            problem("Database.EmbeddedPostgresRuntimePath is required in embedded mode")
+        } else if err := checkWritableDirectory(db.EmbeddedPostgresRuntimePath); err != nil {
+            problem("Database.EmbeddedPostgresRuntimePath %s: %v", db.EmbeddedPostgresRuntimePath, err)
+        }
+        if _, err := db.embeddedVersion(); err != nil {
+            problem("%v", err)
+        }
+        if db.StartTimeout != "" {
+            if _, err := time.ParseDuration(db.StartTimeout); err != nil {
+                problem("Database.StartTimeout is %q, expected a duration like \"45s\"", db.StartTimeout)
+            }
+        }
+        if db.MaxConnections < 0 {
+            problem("Database.MaxConnections is %d, expected a positive number", db.MaxConnections)
+        }
+    case "standalone":
+        if db.Host == "" && db.SocketDirectory == "" {
+            problem("Database.Host or Database.SocketDirectory is required in standalone mode")
+        }
+    default:
+        problem("Database.Mode is %q, expected \"embedded\" or \"standalone\"", db.Mode)
+    }
+    if db.Role == "" {
+        problem("Database.Role is required")
+    }
+    if db.DatabaseName == "" {
+        problem("Database.DatabaseName is required")
+    }
+    if db.Port == 0 || db.Port > 65535 {
+        problem("Database.Port is %d, expected a port number from 1 to 65535", db.Port)
+    }
+
+    // the socket's path, dir/.s.PGSQL.port, has to fit in a sockaddr_un
+    if dir := db.socketDirectory(); len(dir)+len("/.s.PGSQL.65535") > 103 {
+        problem("Database socket directory %s is too long for a unix socket path, set a shorter Database.SocketDirectory", dir)
+    }
+    switch db.auth() {
+    case "password":
+    case "peer":
+        if db.socketDirectory() == "" {
+            problem("Database.Auth peer only works over a unix socket, set Database.SocketDirectory")
+        }
+    case "cert":
+        if db.SSLCert == "" || db.SSLKey == "" {
+            problem("Database.Auth cert needs Database.SSLCert and Database.SSLKey")
+        }
+        if db.SSLMode != "require" && db.SSLMode != "verify-ca" && db.SSLMode != "verify-full" {
+            problem("Database.Auth cert needs Database.SSLMode require, verify-ca or verify-full")
+        }
+    default:
+        problem("Database.Auth is %q, expected \"password\", \"peer\" or \"cert\"", db.Auth)
+    }
+    switch db.SSLMode {
+    case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+    default:
+        problem("Database.SSLMode is %q, expected disable, allow, prefer, require, verify-ca or verify-full", db.SSLMode)
+    }
+    // pools
+    for _, d := range []struct{ name, value string }{
+        {"Database.Pool.MaxConnLifetime", db.Pool.MaxConnLifetime},
+        {"Database.Pool.MaxConnIdleTime", db.Pool.MaxConnIdleTime},
+        {"Database.Pool.HealthCheckPeriod", db.Pool.HealthCheckPeriod},
+        {"Database.Pool.StatementTimeout", db.Pool.StatementTimeout},
+        {"Database.Pool.PGFSStatementTimeout", db.Pool.PGFSStatementTimeout},
+    } {
+        if d.value != "" {
+            if _, err := time.ParseDuration(d.value); err != nil {
+                problem("%s is %q, expected a duration like \"30s\"", d.name, d.value)
+            }
+        }
+    }
+    if db.Pool.MaxConns < 0 || db.Pool.MinConns < 0 || db.Pool.EventsMaxConns < 0 || db.Pool.PGFSMaxConns < 0 {
+        problem("Database.Pool sizes have to be positive")
+    }
+    if db.Pool.MaxConns > 0 && db.Pool.MinConns > db.Pool.MaxConns {
+        problem("Database.Pool.MinConns is %d, more than MaxConns %d", db.Pool.MinConns, db.Pool.MaxConns)
+    }
+    if db.Pool.EventsMaxConns == 1 || db.Pool.EventsMaxConns == 2 {
+        problem("Database.Pool.EventsMaxConns is %d, but socket.io events and the route table each hold one for LISTEN, expected 3 or more", db.Pool.EventsMaxConns)
+    }
+    for _, file := range []struct{ name, path string }{
+        {"Database.SSLCert", db.SSLCert},
+        {"Database.SSLKey", db.SSLKey},
+        {"Database.SSLRootCert", db.SSLRootCert},
+    } {
+        if file.path != "" {
+            if err := checkReadableFile(file.path); err != nil {
+                problem("%s %s: %v", file.name, file.path, err)
+            }
+        }
+    }
+
+    //
+    // HTTPServer
+    //
+    httpServer := config.HTTPServer
+    switch httpServer.Protocol {
+    case "http":
+    case "https":
+        if httpServer.SSLCertificateFile == "" {
+            problem("HTTPServer.SSLCertificateFile is required for https")
+        } else if err := checkReadableFile(httpServer.SSLCertificateFile); err != nil {
+            problem("HTTPServer.SSLCertificateFile %s: %v", httpServer.SSLCertificateFile, err)
+        }
+        if httpServer.SSLKeyFile == "" {
+            problem("HTTPServer.SSLKeyFile is required for https")
+        } else if err := checkReadableFile(httpServer.SSLKeyFile); err != nil {
+            problem("HTTPServer.SSLKeyFile %s: %v", httpServer.SSLKeyFile, err)
+        }
+    default:
+        problem("HTTPServer.Protocol is %q, expected \"http\" or \"https\"", httpServer.Protocol)
+    }
+    if port, err := strconv.Atoi(httpServer.Port); err != nil || port < 1 || port > 65535 {
+        problem("HTTPServer.Port is %q, expected a port number from 1 to 65535", httpServer.Port)
+    }
+    if httpServer.ShutdownTimeout != "" {
+        if _, err := time.ParseDuration(httpServer.ShutdownTimeout); err != nil {
+            problem("HTTPServer.ShutdownTimeout is %q, expected a duration like \"30s\"", httpServer.ShutdownTimeout)
+        }
+    }
+    for _, encoding := range httpServer.Compression.Encodings {
+        if _, ok := encoders[encoding]; !ok {
+            if encoding == "br" {
+                problem("HTTPServer.Compression.Encodings has br, but this server was built without brotli support (-tags brotli)")
+            } else {
+                problem("HTTPServer.Compression.Encodings has %q, expected gzip or br", encoding)
+            }
+        }
+    }
+    if httpServer.Compression.MinSize < 0 {
+        problem("HTTPServer.Compression.MinSize is %d, expected 0 or more", httpServer.Compression.MinSize)
+    }
+
+    //
+    // PGFS
+    //
+    if config.PGFS.Enabled {
+        if config.PGFS.MountDirectory == "" {
+            problem("PGFS.MountDirectory is required when PGFS is enabled")
+        } else if info, err := os.Stat(config.PGFS.MountDirectory); err != nil {
+            problem("PGFS.MountDirectory %s: %v", config.PGFS.MountDirectory, err)
+        } else if !info.IsDir() {
+            problem("PGFS.MountDirectory %s is not a directory", config.PGFS.MountDirectory)
+        }
+    }
+
+    //
+    // Bundles
+    //
+    for i, bundle := range config.Bundles.Bundle {
+        if bundle.Name == "" {
+            problem("Bundles.Bundle %d has no Name", i+1)
+        }
+    }
+
+    return problems
+}
+
+// checkWritableDirectory checks that dir, or the nearest existing directory
+// above it, is a directory the server can create files in.
+func checkWritableDirectory(dir string) error {
+    info, err := os.Stat(dir)
+    for os.IsNotExist(err) && filepath.Dir(dir) != dir {
+        dir = filepath.Dir(dir)
+        info, err = os.Stat(dir)
+    }
+    if err != nil {
+        return err
+    }
+    if !info.IsDir() {
+        return fmt.Errorf("%s is not a directory", dir)
+    }
+
+    f, err := ioutil.TempFile(dir, ".aquameta-check-*")
+    if err != nil {
+        return fmt.Errorf("%s is not writable", dir)
+    }
+    f.Close()
+    return os.Remove(f.Name())
+}
+
+func checkReadableFile(file string) error {
+    f, err := os.Open(file)
+    if err != nil {
+        return err
+    }
+    return f.Close()
+}
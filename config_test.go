@@ -0,0 +1,205 @@
+package main
+
+import (
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// validStandaloneConfig returns a config validateConfig has no problems with.
+func validStandaloneConfig() tomlConfig {
+    return tomlConfig{
+        Database: Database{
+            Mode: "standalone",
+            Role: "aquameta",
+            Host: "localhost",
+            Port: 5432,
+            DatabaseName: "aquameta",
+        },
+        HTTPServer: HTTPServer{
+            Protocol: "http",
+            Port: "9000",
+        },
+    }
+}
+
+func TestValidateConfig(t *testing.T) {
+    dir := t.TempDir()
+    missing := filepath.Join(dir, "missing")
+
+    tests := []struct {
+        name string
+        change func(*tomlConfig)
+        problems []string
+    }{
+        {
+            name: "valid standalone",
+            change: func(c *tomlConfig) {},
+        },
+        {
+            name: "valid embedded",
+            change: func(c *tomlConfig) {
+                c.Database.Mode = "embedded"
+                c.Database.Host = ""
+                c.Database.EmbeddedPostgresRuntimePath = filepath.Join(dir, "pg")
+                c.Database.Version = "9.6"
+                c.Database.StartTimeout = "2m"
+            },
+        },
+        {
+            name: "valid with every option",
+            change: func(c *tomlConfig) {
+                c.HTTPServer.ShutdownTimeout = "10s"
+                c.HTTPServer.Compression = Compression{Encodings: []string{"gzip"}, MinSize: 256}
+                c.PGFS = PGFS{Enabled: true, MountDirectory: dir}
+            },
+        },
+        {
+            name: "valid over a socket with peer auth",
+            change: func(c *tomlConfig) {
+                c.Database.Host = ""
+                c.Database.SocketDirectory = dir
+                c.Database.Auth = "peer"
+                c.Database.Pool = Pool{MaxConns: 10, MinConns: 2, EventsMaxConns: 3, MaxConnLifetime: "1h", StatementTimeout: "0"}
+            },
+        },
+        {
+            name: "empty",
+            change: func(c *tomlConfig) { *c = tomlConfig{} },
+            problems: []string{
+                `Database.Mode is "", expected "embedded" or "standalone"`,
+                "Database.Role is required",
+                "Database.DatabaseName is required",
+                "Database.Port is 0, expected a port number from 1 to 65535",
+                `HTTPServer.Protocol is "", expected "http" or "https"`,
+                `HTTPServer.Port is "", expected a port number from 1 to 65535`,
+            },
+        },
+        {
+            name: "standalone without a host",
+            change: func(c *tomlConfig) { c.Database.Host = "" },
+            problems: []string{"Database.Host or Database.SocketDirectory is required in standalone mode"},
+        },
+        {
+            name: "embedded without a runtime path",
+            change: func(c *tomlConfig) {
+                c.Database.Mode = "embedded"
+                c.Database.Version = "8.4"
+                c.Database.StartTimeout = "soon"
+                c.Database.MaxConnections = -1
+            },
+            problems: []string{
+                "Database.EmbeddedPostgresRuntimePath is required in embedded mode",
+                `Database.Version is "8.4", expected one of 13, 12, 11, 10 or 9.6`,
+                `Database.StartTimeout is "soon", expected a duration like "45s"`,
+                "Database.MaxConnections is -1, expected a positive number",
+            },
+        },
+        {
+            name: "port out of range",
+            change: func(c *tomlConfig) {
+                c.Database.Port = 70000
+                c.HTTPServer.Port = "0"
+            },
+            problems: []string{
+                "Database.Port is 70000, expected a port number from 1 to 65535",
+                `HTTPServer.Port is "0", expected a port number from 1 to 65535`,
+            },
+        },
+        {
+            name: "socket path too long",
+            change: func(c *tomlConfig) { c.Database.SocketDirectory = "/" + strings.Repeat("a", 100) },
+            problems: []string{"Database socket directory /" + strings.Repeat("a", 100) + " is too long for a unix socket path, set a shorter Database.SocketDirectory"},
+        },
+        {
+            name: "peer over TCP",
+            change: func(c *tomlConfig) { c.Database.Auth = "peer" },
+            problems: []string{"Database.Auth peer only works over a unix socket, set Database.SocketDirectory"},
+        },
+        {
+            name: "cert without a certificate",
+            change: func(c *tomlConfig) {
+                c.Database.Auth = "cert"
+                c.Database.SSLMode = "prefer"
+            },
+            problems: []string{
+                "Database.Auth cert needs Database.SSLCert and Database.SSLKey",
+                "Database.Auth cert needs Database.SSLMode require, verify-ca or verify-full",
+            },
+        },
+        {
+            name: "unknown auth and sslmode",
+            change: func(c *tomlConfig) {
+                c.Database.Auth = "trust"
+                c.Database.SSLMode = "always"
+            },
+            problems: []string{
+                `Database.Auth is "trust", expected "password", "peer" or "cert"`,
+                `Database.SSLMode is "always", expected disable, allow, prefer, require, verify-ca or verify-full`,
+            },
+        },
+        {
+            name: "missing certificate files",
+            change: func(c *tomlConfig) { c.Database.SSLRootCert = missing },
+            problems: []string{"Database.SSLRootCert " + missing + ": open " + missing + ": no such file or directory"},
+        },
+        {
+            name: "pools",
+            change: func(c *tomlConfig) {
+                c.Database.Pool = Pool{MaxConns: 4, MinConns: 5, EventsMaxConns: 2, PGFSMaxConns: -1, HealthCheckPeriod: "often"}
+            },
+            problems: []string{
+                `Database.Pool.HealthCheckPeriod is "often", expected a duration like "30s"`,
+                "Database.Pool sizes have to be positive",
+                "Database.Pool.MinConns is 5, more than MaxConns 4",
+                "Database.Pool.EventsMaxConns is 2, but socket.io events and the route table each hold one for LISTEN, expected 3 or more",
+            },
+        },
+        {
+            name: "https without certificates",
+            change: func(c *tomlConfig) {
+                c.HTTPServer.Protocol = "https"
+                c.HTTPServer.SSLKeyFile = missing
+                c.HTTPServer.ShutdownTimeout = "30"
+            },
+            problems: []string{
+                "HTTPServer.SSLCertificateFile is required for https",
+                "HTTPServer.SSLKeyFile " + missing + ": open " + missing + ": no such file or directory",
+                `HTTPServer.ShutdownTimeout is "30", expected a duration like "30s"`,
+            },
+        },
+        {
+            name: "compression",
+            change: func(c *tomlConfig) {
+                c.HTTPServer.Compression = Compression{Encodings: []string{"gzip", "deflate"}, MinSize: -1}
+            },
+            problems: []string{
+                `HTTPServer.Compression.Encodings has "deflate", expected gzip or br`,
+                "HTTPServer.Compression.MinSize is -1, expected 0 or more",
+            },
+        },
+        {
+            name: "pgfs without a mount directory",
+            change: func(c *tomlConfig) { c.PGFS.Enabled = true },
+            problems: []string{"PGFS.MountDirectory is required when PGFS is enabled"},
+        },
+        {
+            name: "pgfs mounted on a file",
+            change: func(c *tomlConfig) { c.PGFS = PGFS{Enabled: true, MountDirectory: "config_test.go"} },
+            problems: []string{"PGFS.MountDirectory config_test.go is not a directory"},
+        },
+        {
+            name: "bundle without a name",
+            change: func(c *tomlConfig) { c.Bundles.Bundle = []Bundle{{Name: "org.aquameta.core.ide"}, {}} },
+            problems: []string{"Bundles.Bundle 2 has no Name"},
+        },
+    }
+    for _, test := range tests {
+        config := validStandaloneConfig()
+        test.change(&config)
+        if problems := validateConfig(config); !reflect.DeepEqual(problems, test.problems) {
+            t.Errorf("%s: validateConfig()\n got %q\nwant %q", test.name, problems, test.problems)
+        }
+    }
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "github.com/jackc/pgx/v4"
+    "io"
+    "log"
+)
+
+// the most of a bytea byteaReader holds in memory at a time
+const byteaChunkSize = 256 * 1024
+
+// the row was updated or deleted after its ETag was sent
+var errContentChanged = errors.New("content changed while it was being sent")
+
+// lazyContent is an io.ReadSeeker over content that's loaded on first use.
+type lazyContent struct {
+    load func() ([]byte, error)
+    reader *bytes.Reader
+}
+
+func (c *lazyContent) open() error {
+    if c.reader != nil {
+        return nil
+    }
+    content, err := c.load()
+    if err != nil {
+        return err
+    }
+    c.reader = bytes.NewReader(content)
+    return nil
+}
+
+func (c *lazyContent) Read(p []byte) (int, error) {
+    if err := c.open(); err != nil {
+        return 0, err
+    }
+    return c.reader.Read(p)
+}
+
+func (c *lazyContent) Seek(offset int64, whence int) (int64, error) {
+    if err := c.open(); err != nil {
+        return 0, err
+    }
+    return c.reader.Seek(offset, whence)
+}
+
+// byteaReader is an io.ReadSeeker over a bytea of a known size, which it reads
+// byteaChunkSize bytes at a time, so a large file, or the part of it a Range
+// asks for, is streamed instead of loaded whole.  read returns the length
+// bytes starting at offset (0-based), or pgx.ErrNoRows if the row is gone.
+// Each chunk is read on its own, so nothing is held between them however
+// slowly the client reads.
+type byteaReader struct {
+    read func(offset int64, length int) ([]byte, error)
+    size int64
+
+    offset int64
+    chunk []byte
+    chunkOffset int64
+}
+
+func (r *byteaReader) Read(p []byte) (int, error) {
+    if r.offset >= r.size {
+        return 0, io.EOF
+    }
+
+    if r.offset < r.chunkOffset || r.offset >= r.chunkOffset+int64(len(r.chunk)) {
+        chunk, err := r.read(r.offset, byteaChunkSize)
+        if err == pgx.ErrNoRows || (err == nil && len(chunk) == 0) {
+            err = errContentChanged
+        }
+        if err != nil {
+            log.Printf("Unable to read bytea at %d of %d: %v", r.offset, r.size, err)
+            return 0, err
+        }
+        r.chunk, r.chunkOffset = chunk, r.offset
+    }
+
+    n := copy(p, r.chunk[r.offset-r.chunkOffset:])
+    r.offset += int64(n)
+    return n, nil
+}
+
+func (r *byteaReader) Seek(offset int64, whence int) (int64, error) {
+    switch whence {
+    case io.SeekStart:
+    case io.SeekCurrent:
+        offset += r.offset
+    case io.SeekEnd:
+        offset += r.size
+    default:
+        return 0, errors.New("byteaReader.Seek: invalid whence")
+    }
+    if offset < 0 {
+        return 0, errors.New("byteaReader.Seek: negative position")
+    }
+    r.offset = offset
+    return offset, nil
+}
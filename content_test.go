@@ -0,0 +1,182 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "github.com/jackc/pgx/v4"
+    "io"
+    "io/ioutil"
+    "testing"
+)
+
+// fakeBytea serves byteaReader's reads from data, and counts them.
+type fakeBytea struct {
+    data []byte
+    reads []int64
+}
+
+func (f *fakeBytea) read(offset int64, length int) ([]byte, error) {
+    f.reads = append(f.reads, offset)
+    if offset >= int64(len(f.data)) {
+        return nil, nil
+    }
+    end := offset + int64(length)
+    if end > int64(len(f.data)) {
+        end = int64(len(f.data))
+    }
+    return f.data[offset:end], nil
+}
+
+func newFakeBytea(size int) *fakeBytea {
+    data := make([]byte, size)
+    for i := range data {
+        data[i] = byte(i % 251)
+    }
+    return &fakeBytea{data: data}
+}
+
+func TestByteaReaderReadAll(t *testing.T) {
+    for _, size := range []int{0, 1, byteaChunkSize, byteaChunkSize*2 + byteaChunkSize/2} {
+        f := newFakeBytea(size)
+        r := &byteaReader{read: f.read, size: int64(size)}
+        content, err := ioutil.ReadAll(r)
+        if err != nil {
+            t.Errorf("%d bytes: %v", size, err)
+            continue
+        }
+        if !bytes.Equal(content, f.data) {
+            t.Errorf("%d bytes: read %d bytes that differ", size, len(content))
+        }
+        if chunks := (size + byteaChunkSize - 1) / byteaChunkSize; len(f.reads) != chunks {
+            t.Errorf("%d bytes: %d reads, want %d", size, len(f.reads), chunks)
+        }
+    }
+}
+
+func TestByteaReaderSeek(t *testing.T) {
+    const size = 100
+    tests := []struct {
+        name string
+        start int64
+        offset int64
+        whence int
+        want int64
+        err bool
+    }{
+        {"start", 50, 10, io.SeekStart, 10, false},
+        {"current", 50, -5, io.SeekCurrent, 45, false},
+        {"end", 50, -1, io.SeekEnd, size - 1, false},
+        {"past the end", 0, 5, io.SeekEnd, size + 5, false},
+        {"negative", 50, -51, io.SeekCurrent, 0, true},
+        {"negative from the end", 0, -size - 1, io.SeekEnd, 0, true},
+        {"invalid whence", 0, 0, 3, 0, true},
+    }
+    for _, test := range tests {
+        r := &byteaReader{read: newFakeBytea(size).read, size: size, offset: test.start}
+        position, err := r.Seek(test.offset, test.whence)
+        if test.err {
+            if err == nil {
+                t.Errorf("%s: Seek(%d, %d) = %d, want an error", test.name, test.offset, test.whence, position)
+            }
+            if r.offset != test.start {
+                t.Errorf("%s: failed Seek moved to %d", test.name, r.offset)
+            }
+            continue
+        }
+        if err != nil || position != test.want {
+            t.Errorf("%s: Seek(%d, %d) = %d, %v, want %d", test.name, test.offset, test.whence, position, err, test.want)
+        }
+    }
+}
+
+func TestByteaReaderRead(t *testing.T) {
+    size := byteaChunkSize + 100
+    f := newFakeBytea(size)
+    r := &byteaReader{read: f.read, size: int64(size)}
+    p := make([]byte, 10)
+
+    // chunks start where the read does
+    if n, err := r.Read(p); n != 10 || err != nil || !bytes.Equal(p, f.data[:10]) {
+        t.Errorf("read %d, %v at the start, want 10", n, err)
+    }
+
+    // a read stops at the end of the chunk
+    r.Seek(byteaChunkSize-3, io.SeekStart)
+    if n, err := r.Read(p); n != 3 || err != nil || !bytes.Equal(p[:n], f.data[byteaChunkSize-3:byteaChunkSize]) {
+        t.Errorf("read %d, %v at the end of a chunk, want 3", n, err)
+    }
+    // and the next one reads the next chunk
+    if n, err := r.Read(p); n != 10 || err != nil || !bytes.Equal(p, f.data[byteaChunkSize:byteaChunkSize+10]) {
+        t.Errorf("read %d, %v at the start of a chunk, want 10", n, err)
+    }
+    if want := []int64{0, byteaChunkSize}; len(f.reads) != 2 || f.reads[0] != want[0] || f.reads[1] != want[1] {
+        t.Errorf("read chunks at %v, want %v", f.reads, want)
+    }
+
+    // seeking within the chunk it holds doesn't read it again
+    r.Seek(-5, io.SeekCurrent)
+    if n, err := r.Read(p); n != 10 || err != nil || !bytes.Equal(p, f.data[byteaChunkSize+5:byteaChunkSize+15]) {
+        t.Errorf("read %d, %v after seeking back, want 10", n, err)
+    }
+    if len(f.reads) != 2 {
+        t.Errorf("read %d chunks, want 2", len(f.reads))
+    }
+
+    // at and past the end
+    for _, offset := range []int64{int64(size), int64(size) + 1} {
+        r.Seek(offset, io.SeekStart)
+        if n, err := r.Read(p); n != 0 || err != io.EOF {
+            t.Errorf("read %d, %v at %d of %d, want io.EOF", n, err, offset, size)
+        }
+    }
+    if len(f.reads) != 2 {
+        t.Errorf("read %d chunks, want 2", len(f.reads))
+    }
+}
+
+func TestByteaReaderErrors(t *testing.T) {
+    failed := errors.New("connection reset")
+    tests := []struct {
+        name string
+        chunk []byte
+        err error
+        want error
+    }{
+        {"row gone", nil, pgx.ErrNoRows, errContentChanged},
+        {"content shorter than it was", []byte{}, nil, errContentChanged},
+        {"database error", nil, failed, failed},
+    }
+    for _, test := range tests {
+        r := &byteaReader{
+            read: func(offset int64, length int) ([]byte, error) { return test.chunk, test.err },
+            size: 10,
+        }
+        if n, err := r.Read(make([]byte, 10)); n != 0 || err != test.want {
+            t.Errorf("%s: read %d, %v, want %v", test.name, n, err, test.want)
+        }
+    }
+}
+
+func TestLazyContent(t *testing.T) {
+    loads := 0
+    c := &lazyContent{load: func() ([]byte, error) {
+        loads++
+        return []byte("hello"), nil
+    }}
+    if size, err := c.Seek(0, io.SeekEnd); size != 5 || err != nil {
+        t.Errorf("Seek to the end = %d, %v, want 5", size, err)
+    }
+    c.Seek(1, io.SeekStart)
+    if content, err := ioutil.ReadAll(c); string(content) != "ello" || err != nil {
+        t.Errorf("read %q, %v, want \"ello\"", content, err)
+    }
+    if loads != 1 {
+        t.Errorf("loaded %d times, want once", loads)
+    }
+
+    failed := errors.New("permission denied")
+    c = &lazyContent{load: func() ([]byte, error) { return nil, failed }}
+    if _, err := c.Read(make([]byte, 1)); err != failed {
+        t.Errorf("Read error %v, want %v", err, failed)
+    }
+}
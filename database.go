@@ -0,0 +1,444 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    embeddedPostgres "github.com/aquametalabs/embedded-postgres"
+    "github.com/jackc/pgconn"
+    "github.com/jackc/pgx/v4"
+    "github.com/jackc/pgx/v4/pgxpool"
+    "github.com/lib/pq"
+    "log"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// embeddedServer builds (but does not start) the embedded PostgreSQL server
+// described by the [Database] section of the config.
+func embeddedServer(config tomlConfig) *embeddedPostgres.EmbeddedPostgres {
+    // validateConfig has already rejected an unknown version
+    version, err := config.Database.embeddedVersion()
+    if err != nil {
+        version = embeddedVersions[defaultEmbeddedVersion]
+    }
+
+    epgConfig := embeddedPostgres.DefaultConfig().
+        Username(config.Database.Role).
+        Password(config.Database.Password).
+        // Host
+        Port(config.Database.Port).
+        Database(config.Database.DatabaseName).
+        Version(version).
+        RuntimePath(config.Database.EmbeddedPostgresRuntimePath).
+        StartTimeout(config.Database.startTimeout())
+    if config.Database.Locale != "" {
+        epgConfig = epgConfig.Locale(config.Database.Locale)
+    }
+
+    // TODO: NewDatabase() should be called NewPGServer() or some such... refactor epg
+    return embeddedPostgres.NewDatabase(epgConfig)
+}
+
+// startDatabase installs the embedded PostgreSQL server if it isn't there yet,
+// starts it and creates the role and database if they don't exist.  In
+// standalone mode there is nothing to start, and it returns nil.
+func startDatabase(config tomlConfig) (*embeddedPostgres.EmbeddedPostgres, error) {
+    if config.Database.Mode != "embedded" {
+        return nil, nil
+    }
+
+    epg := embeddedServer(config)
+
+    // has an embedded postgres already been installed?  Anything in the way
+    // that Aquameta didn't install is left alone.
+    log.Printf("Checking for existing embedded server at %s", config.Database.EmbeddedPostgresRuntimePath)
+    epgFilesExist, err := inspectRuntime(config)
+    if err != nil {
+        return nil, fmt.Errorf("unusable embedded server: %v", err)
+    }
+
+    // if directory doesn't exist, generate an embedded database there
+    if !epgFilesExist {
+        log.Printf("Embedded PostgreSQL server not found at %s.  Installing...", config.Database.EmbeddedPostgresRuntimePath)
+
+        if err := epg.Install(); err != nil {
+            return nil, fmt.Errorf("unable to install PostgreSQL: %v", err)
+        }
+        if err := writeRuntimeMarker(config); err != nil {
+            return nil, fmt.Errorf("unable to mark %s as installed: %v", config.Database.EmbeddedPostgresRuntimePath, err)
+        }
+        log.Printf("PostgreSQL server installed at %s", config.Database.EmbeddedPostgresRuntimePath)
+    } else {
+        log.Printf("Embedded PostgreSQL server found at %s.", config.Database.EmbeddedPostgresRuntimePath)
+
+        adopted, err := adoptRuntime(config)
+        if err != nil {
+            return nil, fmt.Errorf("unable to mark %s as installed: %v", config.Database.EmbeddedPostgresRuntimePath, err)
+        }
+        if adopted {
+            log.Printf("%s had no %s file but checks out as an embedded server; marked it as installed by Aquameta", config.Database.EmbeddedPostgresRuntimePath, runtimeMarkerFile)
+        }
+    }
+
+    // where it listens, which has to be in place before it starts
+    if err := writeListenConfig(config); err != nil {
+        return nil, fmt.Errorf("unable to configure where PostgreSQL listens: %v", err)
+    }
+
+    //
+    // start the epg database daemon
+    //
+    log.Printf("Starting PostgreSQL server from %s...", config.Database.EmbeddedPostgresRuntimePath)
+    if err := epg.Start(); err != nil {
+        return nil, fmt.Errorf("unable to start PostgreSQL: %v", err)
+    }
+    log.Print("PostgreSQL server started.")
+
+    //
+    // postgresql.conf parameters
+    //
+    if err := applyServerSettings(config, epg); err != nil {
+        stopDatabase(epg)
+        return nil, err
+    }
+
+    //
+    // CREATE ROLE, CREATE DATABASE (if they aren't there)
+    //
+    if err := ensureDatabase(config); err != nil {
+        stopDatabase(epg)
+        return nil, err
+    }
+
+    return epg, nil
+}
+
+// stopDatabase stops the embedded PostgreSQL server, if one was started.
+func stopDatabase(epg *embeddedPostgres.EmbeddedPostgres) {
+    if epg == nil || !epg.IsStarted() {
+        return
+    }
+
+    log.Print("Stopping PostgreSQL Server...")
+    if err := epg.Stop(); err != nil {
+        log.Printf("Database halt failed: %v", err)
+    } else {
+        log.Print("Database stopped")
+    }
+}
+
+// maintenanceConnect connects to the server's postgres database, for the work
+// that can't be done from inside the configured one.
+func maintenanceConnect(config tomlConfig) (*pgx.Conn, error) {
+    config.Database.DatabaseName = "postgres"
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    return pgx.Connect(ctx, connectionString(config))
+}
+
+// applyServerSettings writes the configured postgresql.conf parameters with
+// `alter system`, resets the ones `alter system` set before that aren't
+// configured any more, reloads the configuration, and restarts the embedded
+// server if any of them (shared_buffers, max_connections...) only take effect
+// on a restart.  postgresql.auto.conf belongs to the config, so anything set
+// there by hand is reset too.
+func applyServerSettings(config tomlConfig, epg *embeddedPostgres.EmbeddedPostgres) error {
+    settings := config.Database.serverSettings()
+
+    conn, err := maintenanceConnect(config)
+    if err != nil {
+        return fmt.Errorf("unable to connect to apply server settings: %v", err)
+    }
+    ctx := context.Background()
+    defer conn.Close(ctx)
+
+    // alter system can't take bind parameters; a name like
+    // pg_stat_statements.track is quoted part by part
+    quoteName := func(name string) string {
+        parts := strings.Split(name, ".")
+        for i := range parts {
+            parts[i] = pq.QuoteIdentifier(parts[i])
+        }
+        return strings.Join(parts, ".")
+    }
+
+    // pg_file_settings reads the config files each time it's queried
+    const fileSettingsQ = `
+        select distinct f.name
+        from pg_catalog.pg_file_settings f
+        where f.sourcefile like '%postgresql.auto.conf'`
+    names, err := queryNames(ctx, conn, fileSettingsQ)
+    if err != nil {
+        return fmt.Errorf("unable to read server settings: %v", err)
+    }
+    configured := make(map[string]bool)
+    for name := range settings {
+        configured[strings.ToLower(name)] = true
+    }
+    for _, name := range names {
+        if configured[name] {
+            continue
+        }
+        if _, err := conn.Exec(ctx, "alter system reset "+quoteName(name)); err != nil {
+            return fmt.Errorf("unable to reset %s: %v", name, err)
+        }
+        log.Printf("Reset server setting %s, which is no longer configured", name)
+    }
+
+    for name, value := range settings {
+        q := "alter system set " + quoteName(name) + " = " + pq.QuoteLiteral(value)
+        if _, err := conn.Exec(ctx, q); err != nil {
+            return fmt.Errorf("unable to set %s = %s: %v", name, value, err)
+        }
+    }
+    if _, err := conn.Exec(ctx, "select pg_reload_conf()"); err != nil {
+        return fmt.Errorf("unable to reload server settings: %v", err)
+    }
+
+    // pg_settings.pending_restart only shows up once the postmaster gets
+    // around to the reload, but pg_file_settings already knows which entries
+    // it can't apply without a restart
+    const pendingRestartQ = `
+        select distinct f.name
+        from pg_catalog.pg_file_settings f
+            join pg_catalog.pg_settings s on s.name = f.name
+        where f.error is not null
+            and s.context = 'postmaster'`
+    pending, err := queryNames(ctx, conn, pendingRestartQ)
+    if err != nil {
+        return fmt.Errorf("unable to check server settings: %v", err)
+    }
+    if len(pending) == 0 {
+        return nil
+    }
+
+    log.Printf("Restarting PostgreSQL server for %s...", strings.Join(pending, ", "))
+    conn.Close(ctx)
+    if err := epg.Stop(); err != nil {
+        return fmt.Errorf("unable to stop PostgreSQL: %v", err)
+    }
+    if err := epg.Start(); err != nil {
+        return fmt.Errorf("unable to restart PostgreSQL: %v", err)
+    }
+    log.Print("PostgreSQL server restarted.")
+    return nil
+}
+
+// queryNames runs a query selecting one text column.
+func queryNames(ctx context.Context, conn *pgx.Conn, query string) ([]string, error) {
+    rows, err := conn.Query(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var names []string
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            return nil, err
+        }
+        names = append(names, name)
+    }
+    return names, rows.Err()
+}
+
+// ensureDatabase creates the configured role, with the configured password,
+// and the database owned by it, whichever of them doesn't exist yet.  The
+// database gets the configured encoding and locale, from template0 since
+// template1's may differ.
+func ensureDatabase(config tomlConfig) error {
+    conn, err := maintenanceConnect(config)
+    if err != nil {
+        return fmt.Errorf("unable to connect to check for database %s: %v", config.Database.DatabaseName, err)
+    }
+    ctx := context.Background()
+    defer conn.Close(ctx)
+
+    var roleExists bool
+    err = conn.QueryRow(ctx, "select exists(select 1 from pg_catalog.pg_roles where rolname = $1)", config.Database.Role).Scan(&roleExists)
+    if err != nil {
+        return fmt.Errorf("unable to check for role %s: %v", config.Database.Role, err)
+    }
+    if !roleExists {
+        // create role can't take bind parameters
+        q := "create role " + pq.QuoteIdentifier(config.Database.Role) + " with login password " + pq.QuoteLiteral(config.Database.Password)
+        if _, err := conn.Exec(ctx, q); err != nil {
+            return fmt.Errorf("unable to create role %s: %v", config.Database.Role, err)
+        }
+        log.Printf("Created role %s", config.Database.Role)
+    }
+
+    var databaseExists bool
+    err = conn.QueryRow(ctx, "select exists(select 1 from pg_catalog.pg_database where datname = $1)", config.Database.DatabaseName).Scan(&databaseExists)
+    if err != nil {
+        return fmt.Errorf("unable to check for database %s: %v", config.Database.DatabaseName, err)
+    }
+    if databaseExists {
+        return nil
+    }
+
+    q := "create database " + pq.QuoteIdentifier(config.Database.DatabaseName) + " with owner " + pq.QuoteIdentifier(config.Database.Role)
+    if config.Database.Encoding != "" || config.Database.Locale != "" {
+        q += " template template0"
+    }
+    if config.Database.Encoding != "" {
+        q += " encoding " + pq.QuoteLiteral(config.Database.Encoding)
+    }
+    if config.Database.Locale != "" {
+        q += " lc_collate " + pq.QuoteLiteral(config.Database.Locale) + " lc_ctype " + pq.QuoteLiteral(config.Database.Locale)
+    }
+    if _, err := conn.Exec(ctx, q); err != nil {
+        return fmt.Errorf("unable to create database %s: %v", config.Database.DatabaseName, err)
+    }
+    log.Printf("Created database %s", config.Database.DatabaseName)
+    return nil
+}
+
+// connectionString builds the libpq connection URI for the configured database,
+// over TCP or the unix socket, with the password only for password auth.
+func connectionString(config tomlConfig) string {
+    db := config.Database
+    port := strconv.Itoa(int(db.Port))
+
+    u := url.URL{Scheme: "postgresql", Path: "/" + db.DatabaseName}
+    // no password at all rather than an empty one, so libpq falls back to
+    // PGPASSWORD and ~/.pgpass
+    if db.auth() == "password" && db.Password != "" {
+        u.User = url.UserPassword(db.Role, db.Password)
+    } else {
+        u.User = url.User(db.Role)
+    }
+
+    params := url.Values{}
+    if dir := db.socketDirectory(); dir != "" {
+        params.Set("host", dir)
+        params.Set("port", port)
+    } else {
+        u.Host = net.JoinHostPort(db.Host, port)
+    }
+    if db.SSLMode != "" {
+        params.Set("sslmode", db.SSLMode)
+    }
+    if db.SSLCert != "" {
+        params.Set("sslcert", db.SSLCert)
+    }
+    if db.SSLKey != "" {
+        params.Set("sslkey", db.SSLKey)
+    }
+    if db.SSLRootCert != "" {
+        params.Set("sslrootcert", db.SSLRootCert)
+    }
+    u.RawQuery = params.Encode()
+    return u.String()
+}
+
+// connectDatabase opens a connection pool for installing, upgrading and
+// checking on Aquameta, whose statements (like importing a bundle) can take as
+// long as they take.
+func connectDatabase(config tomlConfig) (*pgxpool.Pool, error) {
+    return connectPool(config, "admin", 0, 0, "0")
+}
+
+// connectHTTPPool opens the connection pool used by the HTTP handlers.
+// Handlers pass request data as bind parameters, never as SQL text; pgx
+// prepares those queries and caches the statements on each connection.
+func connectHTTPPool(config tomlConfig) (*pgxpool.Pool, error) {
+    pool := config.Database.Pool
+    statementTimeout := pool.StatementTimeout
+    if statementTimeout == "" {
+        statementTimeout = defaultStatementTimeout
+    }
+    return connectPool(config, "HTTP", pool.MaxConns, pool.MinConns, statementTimeout)
+}
+
+// connectEventsPool opens the connection pool for socket.io events.
+func connectEventsPool(config tomlConfig) (*pgxpool.Pool, error) {
+    maxConns := config.Database.Pool.EventsMaxConns
+    if maxConns == 0 {
+        maxConns = defaultEventsMaxConns
+    }
+    // no statement timeout, LISTEN waits for as long as it takes
+    return connectPool(config, "events", maxConns, 0, "0")
+}
+
+// connectPGFSPool opens the connection pool for PGFS.
+func connectPGFSPool(config tomlConfig) (*pgxpool.Pool, error) {
+    maxConns := config.Database.Pool.PGFSMaxConns
+    if maxConns == 0 {
+        maxConns = defaultPGFSMaxConns
+    }
+    statementTimeout := config.Database.Pool.PGFSStatementTimeout
+    if statementTimeout == "" {
+        statementTimeout = defaultPGFSStatementTimeout
+    }
+    return connectPool(config, "PGFS", maxConns, 0, statementTimeout)
+}
+
+// connectPool opens a connection pool of at most maxConns connections (0 for
+// pgx's default) with the configured lifetimes and health checks.  Each new
+// connection gets the session settings, and a statement_timeout of
+// statementTimeout.
+func connectPool(config tomlConfig, name string, maxConns int32, minConns int32, statementTimeout string) (*pgxpool.Pool, error) {
+    connectionString := connectionString(config)
+    log.Printf("Database (%s pool): %s", name, redact(connectionString))
+
+    poolConfig, err := pgxpool.ParseConfig(connectionString)
+    if err != nil {
+        return nil, fmt.Errorf("invalid connection settings: %v", err)
+    }
+
+    // validateConfig has already rejected durations that don't parse
+    pool := config.Database.Pool
+    if maxConns > 0 {
+        poolConfig.MaxConns = maxConns
+    }
+    if minConns > 0 {
+        poolConfig.MinConns = minConns
+    }
+    if d, err := time.ParseDuration(pool.MaxConnLifetime); err == nil {
+        poolConfig.MaxConnLifetime = d
+    }
+    if d, err := time.ParseDuration(pool.MaxConnIdleTime); err == nil {
+        poolConfig.MaxConnIdleTime = d
+    }
+    if d, err := time.ParseDuration(pool.HealthCheckPeriod); err == nil {
+        poolConfig.HealthCheckPeriod = d
+    }
+
+    settings := config.Database.sessionSettings()
+    if d, err := time.ParseDuration(statementTimeout); err == nil {
+        settings["statement_timeout"] = strconv.FormatInt(d.Milliseconds(), 10)
+    }
+    poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+        return applySessionSettings(ctx, conn, settings)
+    }
+
+    dbpool, err := pgxpool.ConnectConfig(context.Background(), poolConfig)
+    if err != nil {
+        return nil, fmt.Errorf("unable to connect to database: %v", err)
+    }
+    log.Printf("Connected to database (%s pool, at most %d connections).", name, poolConfig.MaxConns)
+    return dbpool, nil
+}
+
+// applySessionSettings sets each setting for the rest of conn's session.  The
+// ones only a superuser may set, like log_statement, are skipped with a
+// warning when the role isn't one.
+func applySessionSettings(ctx context.Context, conn *pgx.Conn, settings map[string]string) error {
+    for name, value := range settings {
+        _, err := conn.Exec(ctx, "select pg_catalog.set_config($1, $2, false)", name, value)
+        var pgErr *pgconn.PgError
+        if errors.As(err, &pgErr) && pgErr.Code == "42501" {
+            log.Printf("Not permitted to set %s for %s, skipping it", name, conn.Config().User)
+            continue
+        }
+        if err != nil {
+            return fmt.Errorf("unable to set %s = %s: %v", name, value, err)
+        }
+    }
+    return nil
+}
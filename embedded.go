@@ -0,0 +1,187 @@
+package main
+
+import (
+    "fmt"
+    "github.com/lib/pq"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+)
+
+// the file Aquameta writes into an embedded runtime directory it installed,
+// so it never mistakes (and never installs over) some other directory
+const runtimeMarkerFile = ".aquameta-runtime"
+
+// the binaries an embedded runtime directory has to have
+var runtimeBinaries = [...]string{"postgres", "pg_ctl", "initdb"}
+
+// inspectRuntime checks the embedded runtime directory.  It returns false if
+// there is nothing there yet to be installed over, true if it holds a server
+// that matches the config, and otherwise an error saying exactly what's wrong
+// with it.  A directory without the marker file, from before Aquameta wrote
+// one, is only accepted if it passes every check; see adoptRuntime.
+func inspectRuntime(config tomlConfig) (bool, error) {
+    runtimePath := config.Database.EmbeddedPostgresRuntimePath
+
+    info, err := os.Stat(runtimePath)
+    if os.IsNotExist(err) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    if !info.IsDir() {
+        return false, fmt.Errorf("%s is not a directory", runtimePath)
+    }
+
+    entries, err := ioutil.ReadDir(runtimePath)
+    if err != nil {
+        return false, err
+    }
+    if len(entries) == 0 {
+        return false, nil
+    }
+
+    version, err := config.Database.embeddedVersion()
+    if err != nil {
+        return false, err
+    }
+
+    // the marker
+    marker, err := ioutil.ReadFile(filepath.Join(runtimePath, runtimeMarkerFile))
+    if os.IsNotExist(err) {
+        if err := checkRuntime(runtimePath, string(version)); err != nil {
+            return false, fmt.Errorf("%s is not empty and has no %s file, and isn't an embedded server Aquameta can use (%v); refusing to use or install over it", runtimePath, runtimeMarkerFile, err)
+        }
+        return true, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    markerVersion := strings.TrimSpace(string(marker))
+
+    if majorVersion(markerVersion) != majorVersion(string(version)) {
+        return false, fmt.Errorf("%s has PostgreSQL %s installed, but Database.Version is %s", runtimePath, markerVersion, majorVersion(string(version)))
+    }
+    return true, checkRuntime(runtimePath, markerVersion)
+}
+
+// checkRuntime checks that runtimePath has the binaries, and a data directory
+// of version's that this user owns.
+func checkRuntime(runtimePath string, version string) error {
+    // binaries
+    for _, binary := range runtimeBinaries {
+        if runtime.GOOS == "windows" {
+            binary += ".exe"
+        }
+        path := filepath.Join(runtimePath, "bin", binary)
+        info, err := os.Stat(path)
+        if err != nil {
+            return fmt.Errorf("%s is missing %s: %v", runtimePath, filepath.Join("bin", binary), err)
+        }
+        if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+            return fmt.Errorf("%s is not executable", path)
+        }
+    }
+
+    // data directory
+    dataDirectory := filepath.Join(runtimePath, "data")
+    info, err := os.Stat(dataDirectory)
+    if err != nil {
+        return fmt.Errorf("%s has no data directory: %v", runtimePath, err)
+    }
+    if err := checkDataDirectoryOwner(dataDirectory, info); err != nil {
+        return err
+    }
+
+    pgVersion, err := ioutil.ReadFile(filepath.Join(dataDirectory, "PG_VERSION"))
+    if err != nil {
+        return fmt.Errorf("%s is not a PostgreSQL data directory: %v", dataDirectory, err)
+    }
+    if dataVersion := strings.TrimSpace(string(pgVersion)); dataVersion != majorVersion(version) {
+        return fmt.Errorf("%s was initialized by PostgreSQL %s, not %s", dataDirectory, dataVersion, version)
+    }
+    return nil
+}
+
+// writeRuntimeMarker marks the runtime directory as installed by Aquameta.
+func writeRuntimeMarker(config tomlConfig) error {
+    version, err := config.Database.embeddedVersion()
+    if err != nil {
+        return err
+    }
+    marker := filepath.Join(config.Database.EmbeddedPostgresRuntimePath, runtimeMarkerFile)
+    return ioutil.WriteFile(marker, []byte(string(version)+"\n"), 0644)
+}
+
+// adoptRuntime writes the marker into a runtime directory inspectRuntime
+// accepted without one, i.e. one installed before Aquameta marked them.  It
+// returns whether it did.
+func adoptRuntime(config tomlConfig) (bool, error) {
+    marker := filepath.Join(config.Database.EmbeddedPostgresRuntimePath, runtimeMarkerFile)
+    if _, err := os.Stat(marker); !os.IsNotExist(err) {
+        return false, err
+    }
+    return true, writeRuntimeMarker(config)
+}
+
+// the file in the data directory with the settings writeListenConfig manages,
+// included from postgresql.conf
+const listenConfigFile = "aquameta.conf"
+
+// writeListenConfig sets where the embedded server listens: only on a unix
+// socket in a directory of its own that only this user can reach, unless
+// Database.ListenAddresses asks for TCP too.  These only take effect on a
+// (re)start, so they go in a file postgresql.conf includes rather than through
+// `alter system`, which would need a connection first.
+func writeListenConfig(config tomlConfig) error {
+    dataDirectory := filepath.Join(config.Database.EmbeddedPostgresRuntimePath, "data")
+
+    settings := "# written by aquameta on every start, edit conf/boot.toml instead\n" +
+        "listen_addresses = " + pq.QuoteLiteral(config.Database.listenAddresses()) + "\n"
+    if dir := config.Database.socketDirectory(); dir != "" {
+        if err := os.MkdirAll(dir, 0700); err != nil {
+            return err
+        }
+        if err := os.Chmod(dir, 0700); err != nil {
+            return err
+        }
+        settings += "unix_socket_directories = " + pq.QuoteLiteral(dir) + "\n" +
+            "unix_socket_permissions = 0700\n"
+    }
+    if err := ioutil.WriteFile(filepath.Join(dataDirectory, listenConfigFile), []byte(settings), 0600); err != nil {
+        return err
+    }
+
+    // include it from postgresql.conf, once
+    postgresqlConf := filepath.Join(dataDirectory, "postgresql.conf")
+    conf, err := ioutil.ReadFile(postgresqlConf)
+    if err != nil {
+        return err
+    }
+    include := "include_if_exists = '" + listenConfigFile + "'"
+    if strings.Contains(string(conf), include) {
+        return nil
+    }
+    f, err := os.OpenFile(postgresqlConf, os.O_APPEND|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    if _, err := f.WriteString("\n" + include + "\n"); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// majorVersion returns the major version PG_VERSION holds for a version, e.g.
+// 12 for 12.5.0, and 9.6 for 9.6.20.
+func majorVersion(version string) string {
+    parts := strings.Split(version, ".")
+    if len(parts) >= 2 && parts[0] == "9" {
+        return parts[0] + "." + parts[1]
+    }
+    return parts[0]
+}
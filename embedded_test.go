@@ -0,0 +1,177 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "testing"
+)
+
+func TestMajorVersion(t *testing.T) {
+    tests := []struct {
+        version string
+        want string
+    }{
+        {"13.1.0", "13"},
+        {"12.5.0", "12"},
+        {"12", "12"},
+        {"10.15.0", "10"},
+        {"9.6.20", "9.6"},
+        {"9.6", "9.6"},
+        {"", ""},
+    }
+    for _, test := range tests {
+        if got := majorVersion(test.version); got != test.want {
+            t.Errorf("majorVersion(%q) = %q, want %q", test.version, got, test.want)
+        }
+    }
+}
+
+// runtimeFixture describes an embedded runtime directory to create.
+type runtimeFixture struct {
+    binaries []string
+    dataMode os.FileMode        // no data directory if 0
+    pgVersion string            // no PG_VERSION if ""
+    marker string               // no marker file if ""
+    other string                // some other file, if not ""
+}
+
+func (f runtimeFixture) create(t *testing.T, dir string) {
+    write := func(path string, content string, mode os.FileMode) {
+        if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+            t.Fatal(err)
+        }
+        if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for _, binary := range f.binaries {
+        if runtime.GOOS == "windows" {
+            binary += ".exe"
+        }
+        write(filepath.Join(dir, "bin", binary), "", 0755)
+    }
+    if f.dataMode != 0 {
+        data := filepath.Join(dir, "data")
+        if err := os.MkdirAll(data, 0700); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.Chmod(data, f.dataMode); err != nil {
+            t.Fatal(err)
+        }
+        if f.pgVersion != "" {
+            write(filepath.Join(data, "PG_VERSION"), f.pgVersion+"\n", 0600)
+        }
+    }
+    if f.marker != "" {
+        write(filepath.Join(dir, runtimeMarkerFile), f.marker+"\n", 0644)
+    }
+    if f.other != "" {
+        write(filepath.Join(dir, f.other), "", 0644)
+    }
+}
+
+func TestInspectRuntime(t *testing.T) {
+    version, _ := Database{}.embeddedVersion()
+    installed := runtimeFixture{binaries: runtimeBinaries[:], dataMode: 0700, pgVersion: majorVersion(string(version))}
+    marked := installed
+    marked.marker = string(version)
+
+    tests := []struct {
+        name string
+        fixture *runtimeFixture      // no directory if nil
+        found bool
+        adopted bool
+        err string
+        unixOnly bool
+    }{
+        {name: "missing", fixture: nil},
+        {name: "empty", fixture: &runtimeFixture{}},
+        {name: "marked", fixture: &marked, found: true},
+        {name: "unmarked", fixture: &installed, found: true, adopted: true},
+        {
+            name: "marked for another version",
+            fixture: &runtimeFixture{binaries: runtimeBinaries[:], dataMode: 0700, pgVersion: "11", marker: "11.10.0"},
+            err: "has PostgreSQL 11.10.0 installed, but Database.Version is " + majorVersion(string(version)),
+        },
+        {
+            name: "marked without its binaries",
+            fixture: &runtimeFixture{dataMode: 0700, pgVersion: majorVersion(string(version)), marker: string(version)},
+            err: "is missing " + filepath.Join("bin", "postgres"),
+        },
+        {
+            name: "unmarked, not a runtime",
+            fixture: &runtimeFixture{other: "notes.txt"},
+            err: "has no " + runtimeMarkerFile + " file, and isn't an embedded server Aquameta can use",
+        },
+        {
+            name: "unmarked, without a data directory",
+            fixture: &runtimeFixture{binaries: runtimeBinaries[:]},
+            err: "has no data directory",
+        },
+        {
+            name: "unmarked, initialized by another version",
+            fixture: &runtimeFixture{binaries: runtimeBinaries[:], dataMode: 0700, pgVersion: "11"},
+            err: "was initialized by PostgreSQL 11, not " + string(version),
+        },
+        {
+            name: "data directory others can read",
+            fixture: &runtimeFixture{binaries: runtimeBinaries[:], dataMode: 0755, pgVersion: majorVersion(string(version)), marker: string(version)},
+            err: "expected u=rwx (0700) or u=rwx,g=rx (0750)",
+            unixOnly: true,
+        },
+    }
+    for _, test := range tests {
+        if test.unixOnly && runtime.GOOS == "windows" {
+            continue
+        }
+        runtimePath := filepath.Join(t.TempDir(), "pg")
+        if test.fixture != nil {
+            if err := os.Mkdir(runtimePath, 0700); err != nil {
+                t.Fatal(err)
+            }
+            test.fixture.create(t, runtimePath)
+        }
+        config := tomlConfig{Database: Database{Mode: "embedded", EmbeddedPostgresRuntimePath: runtimePath}}
+
+        found, err := inspectRuntime(config)
+        if test.err != "" {
+            if err == nil || !strings.Contains(err.Error(), test.err) {
+                t.Errorf("%s: error %v, want one containing %q", test.name, err, test.err)
+            }
+            continue
+        }
+        if err != nil || found != test.found {
+            t.Errorf("%s: inspectRuntime() = %v, %v, want %v", test.name, found, err, test.found)
+            continue
+        }
+        if !found {
+            continue
+        }
+
+        adopted, err := adoptRuntime(config)
+        if err != nil || adopted != test.adopted {
+            t.Errorf("%s: adoptRuntime() = %v, %v, want %v", test.name, adopted, err, test.adopted)
+        }
+        marker, err := ioutil.ReadFile(filepath.Join(runtimePath, runtimeMarkerFile))
+        if err != nil || strings.TrimSpace(string(marker)) != string(version) {
+            t.Errorf("%s: marker %q, %v, want %s", test.name, marker, err, version)
+        }
+        if adopted, err := adoptRuntime(config); adopted || err != nil {
+            t.Errorf("%s: adopted again: %v, %v", test.name, adopted, err)
+        }
+    }
+}
+
+func TestInspectRuntimeNotADirectory(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "pg")
+    if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    config := tomlConfig{Database: Database{Mode: "embedded", EmbeddedPostgresRuntimePath: file}}
+    if _, err := inspectRuntime(config); err == nil || !strings.Contains(err.Error(), "is not a directory") {
+        t.Errorf("error %v, want not a directory", err)
+    }
+}
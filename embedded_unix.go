@@ -0,0 +1,25 @@
+//go:build !windows
+package main
+
+import (
+    "fmt"
+    "os"
+    "syscall"
+)
+
+// checkDataDirectoryOwner checks the data directory the way postgres will when
+// it starts: it has to belong to the user running the server, and not be open
+// to everyone else.
+func checkDataDirectoryOwner(dataDirectory string, info os.FileInfo) error {
+    stat, ok := info.Sys().(*syscall.Stat_t)
+    if !ok {
+        return nil
+    }
+    if int(stat.Uid) != os.Getuid() {
+        return fmt.Errorf("%s is owned by uid %d, but the server runs as uid %d", dataDirectory, stat.Uid, os.Getuid())
+    }
+    if info.Mode().Perm()&0027 != 0 {
+        return fmt.Errorf("%s has permissions %v, expected u=rwx (0700) or u=rwx,g=rx (0750)", dataDirectory, info.Mode().Perm())
+    }
+    return nil
+}
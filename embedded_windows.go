@@ -0,0 +1,12 @@
+//go:build windows
+package main
+
+import (
+    "os"
+)
+
+// checkDataDirectoryOwner has nothing to check on Windows, where postgres
+// doesn't check the data directory's owner either.
+func checkDataDirectoryOwner(dataDirectory string, info os.FileInfo) error {
+    return nil
+}
@@ -3,9 +3,7 @@ package main
 import (
     "context"
     "encoding/json"
-    "fmt"
     "github.com/jackc/pgx/v4/pgxpool"
-    "github.com/lib/pq"
     "io"
     "io/ioutil"
     "log"
@@ -21,6 +19,10 @@ func endpoint(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
 
         // api version, sub-path
         s := strings.SplitN(req.URL.Path, "/", 4)
+        if len(s) < 4 {
+            http.Error(w, "Expected /endpoint/{version}/{path}", http.StatusNotFound)
+            return
+        }
         version, apiPath := s[2], s[3]
 
         if version != "0.3" {
@@ -30,11 +32,14 @@ func endpoint(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
         // convert query string to JSON
         m, err := url.ParseQuery(req.URL.RawQuery)
         if err != nil {
-            log.Fatal(err)
+            http.Error(w, "Malformed query string: "+err.Error(), http.StatusBadRequest)
+            return
         }
         q, err := json.Marshal(m)
         if err != nil {
-            log.Fatal(err)
+            log.Printf("Unable to convert query string to JSON: %v", err)
+            http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+            return
         }
         queryStringJSON := string(q)
         if queryStringJSON == "" {
@@ -56,7 +61,8 @@ func endpoint(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
         // read request body
         r, err := ioutil.ReadAll(req.Body)
         if err != nil {
-            log.Fatal(err)
+            http.Error(w, "Unable to read request body: "+err.Error(), http.StatusBadRequest)
+            return
         }
         requestBody := string(r)
         if requestBody == "" {
@@ -69,22 +75,31 @@ func endpoint(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
         var mimetype string
         var response string
 
-        var dbQuery = fmt.Sprintf(
-            "select status, message, response, mimetype from endpoint.request(%v, %v, %v, %v::json, %v::json)",
-            pq.QuoteLiteral(version),
-            pq.QuoteLiteral(req.Method),
-            pq.QuoteLiteral(apiPath),
-            pq.QuoteLiteral(queryStringJSON),
-            pq.QuoteLiteral(requestBody))
+        const dbQuery = "select status, message, response, mimetype from endpoint.request($1, $2, $3, $4::json, $5::json)"
+
+        // run as the session's role
+        ctx := context.Background()
+        role := sessionRole(ctx, dbpool, req)
+        tx, err := beginAs(ctx, dbpool, role)
+        if err != nil {
+            log.Printf("Unable to begin request transaction as %s: %v", role, err)
+            writeError(w, err)
+            return
+        }
+        defer tx.Rollback(ctx)
 
         // query endpoint.request()
-        err = dbpool.QueryRow(context.Background(), dbQuery).Scan(&status, &message, &response, &mimetype)
+        err = tx.QueryRow(ctx, dbQuery, version, req.Method, apiPath, queryStringJSON, requestBody).Scan(&status, &message, &response, &mimetype)
+        if err == nil {
+            err = tx.Commit(ctx)
+        }
 
         // unhandled exception in endpoint.request()
         if err != nil {
             log.Printf("💥💥💥💥 API Query failed, unhandled exception: %s", err)
             log.Printf("REQUEST:\nversion: %s\nmessage: %s\nresponse: %s\nmimetype: %s\n\n", version, message, response, mimetype)
             log.Printf("RESPONSE:\ndbQuery: %s\nreq.Proto: %s\nreq.RequestURI: %s\nrequestBody: %s\nqueryStringJSON: %s\n\n", dbQuery, req.Proto, req.RequestURI, requestBody, queryStringJSON)
+            writeError(w, err)
             return
         }
 
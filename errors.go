@@ -0,0 +1,113 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/jackc/pgconn"
+    "github.com/jackc/pgx/v4"
+    "log"
+    "net/http"
+    "runtime/debug"
+    "strings"
+)
+
+// httpStatus maps an error from the database to an HTTP status by its
+// SQLSTATE, or to 404 for a query that found no row.  This replaces the uwsgi
+// endpoint's map_errors_to_http, which matched on the message text.
+func httpStatus(err error) int {
+    // e.g. a route deleted since the route table was loaded
+    if errors.Is(err, pgx.ErrNoRows) {
+        return http.StatusNotFound
+    }
+
+    var pgErr *pgconn.PgError
+    if !errors.As(err, &pgErr) {
+        // not raised by PostgreSQL, e.g. a lost connection
+        return http.StatusInternalServerError
+    }
+
+    switch pgErr.Code {
+    case "42P01", // undefined_table
+        "42883",  // undefined_function
+        "42703",  // undefined_column
+        "42704",  // undefined_object
+        "3F000",  // invalid_schema_name
+        "P0002":  // no_data_found
+        return http.StatusNotFound
+    case "42501": // insufficient_privilege
+        return http.StatusForbidden
+    case "28000", // invalid_authorization_specification, e.g. role is not permitted to log in
+        "28P01":  // invalid_password
+        return http.StatusUnauthorized
+    case "23505", // unique_violation
+        "42710":  // duplicate_object
+        return http.StatusConflict
+    case "57014": // query_canceled, e.g. statement_timeout
+        return http.StatusGatewayTimeout
+    }
+
+    // raise exception without an errcode, from functions that don't set one
+    // yet, e.g. bundle.checkout()'s "commit ... does not exist"
+    if pgErr.Code == "P0001" && strings.HasSuffix(pgErr.Message, "does not exist") {
+        return http.StatusNotFound
+    }
+
+    switch {
+    case strings.HasPrefix(pgErr.Code, "08"), // connection_exception
+        strings.HasPrefix(pgErr.Code, "53"),  // insufficient_resources
+        strings.HasPrefix(pgErr.Code, "57P"): // admin_shutdown, crash_shutdown, cannot_connect_now...
+        return http.StatusServiceUnavailable
+    case strings.HasPrefix(pgErr.Code, "XX"): // internal_error
+        return http.StatusInternalServerError
+    }
+    return http.StatusBadRequest
+}
+
+// errorResponse is the JSON body sent for a failed request.
+type errorResponse struct {
+    Status int `json:"status"`
+    Code string `json:"code,omitempty"`
+    Message string `json:"message"`
+    Detail string `json:"detail,omitempty"`
+    Hint string `json:"hint,omitempty"`
+}
+
+// writeError sends err as a JSON error response with the status httpStatus
+// chooses.  Only errors raised by PostgreSQL have their message passed on,
+// and only client errors their detail and hint, which for a server error can
+// hold the server's own internals.
+func writeError(w http.ResponseWriter, err error) {
+    status := httpStatus(err)
+    body := errorResponse{Status: status, Message: http.StatusText(status)}
+
+    var pgErr *pgconn.PgError
+    if errors.As(err, &pgErr) {
+        body.Code = pgErr.Code
+        body.Message = pgErr.Message
+        if status < 500 {
+            body.Detail = pgErr.Detail
+            body.Hint = pgErr.Hint
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(body)
+}
+
+// recoverPanics turns a panic in a handler into a 500 for that request,
+// logging the stack, instead of letting it take the server down.
+func recoverPanics(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        defer func() {
+            if p := recover(); p != nil {
+                if p == http.ErrAbortHandler {
+                    panic(p)
+                }
+                log.Printf("💥 panic serving %s %s: %v\n%s", req.Method, req.RequestURI, p, debug.Stack())
+                http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+            }
+        }()
+        next.ServeHTTP(w, req)
+    })
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/jackc/pgconn"
+    "github.com/jackc/pgx/v4"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestHTTPStatus(t *testing.T) {
+    tests := []struct {
+        name string
+        err error
+        status int
+    }{
+        {"undefined_table", &pgconn.PgError{Code: "42P01"}, http.StatusNotFound},
+        {"undefined_function", &pgconn.PgError{Code: "42883"}, http.StatusNotFound},
+        {"no_data_found", &pgconn.PgError{Code: "P0002"}, http.StatusNotFound},
+        {"no rows", pgx.ErrNoRows, http.StatusNotFound},
+        {"wrapped no rows", fmt.Errorf("reading: %w", pgx.ErrNoRows), http.StatusNotFound},
+        {"insufficient_privilege", &pgconn.PgError{Code: "42501"}, http.StatusForbidden},
+        {"invalid_password", &pgconn.PgError{Code: "28P01"}, http.StatusUnauthorized},
+        {"invalid_authorization_specification", &pgconn.PgError{Code: "28000"}, http.StatusUnauthorized},
+        {"unique_violation", &pgconn.PgError{Code: "23505"}, http.StatusConflict},
+        {"duplicate_object", &pgconn.PgError{Code: "42710"}, http.StatusConflict},
+        {"query_canceled", &pgconn.PgError{Code: "57014"}, http.StatusGatewayTimeout},
+        {"connection_failure", &pgconn.PgError{Code: "08006"}, http.StatusServiceUnavailable},
+        {"too_many_connections", &pgconn.PgError{Code: "53300"}, http.StatusServiceUnavailable},
+        {"admin_shutdown", &pgconn.PgError{Code: "57P01"}, http.StatusServiceUnavailable},
+        {"internal_error", &pgconn.PgError{Code: "XX000"}, http.StatusInternalServerError},
+        {"raise_exception", &pgconn.PgError{Code: "P0001"}, http.StatusBadRequest},
+        {"raise_exception does not exist", &pgconn.PgError{Code: "P0001", Message: "bundle.checkout() commit with id 1 does not exist"}, http.StatusNotFound},
+        {"invalid_text_representation", &pgconn.PgError{Code: "22P02"}, http.StatusBadRequest},
+        {"wrapped", fmt.Errorf("calling: %w", &pgconn.PgError{Code: "42501"}), http.StatusForbidden},
+        {"not from postgres", errors.New("connection reset by peer"), http.StatusInternalServerError},
+    }
+    for _, test := range tests {
+        if status := httpStatus(test.err); status != test.status {
+            t.Errorf("%s: httpStatus(%v) = %d, want %d", test.name, test.err, status, test.status)
+        }
+    }
+}
+
+func TestWriteError(t *testing.T) {
+    tests := []struct {
+        name string
+        err error
+        want errorResponse
+    }{
+        {
+            "postgres",
+            &pgconn.PgError{Code: "42501", Message: "permission denied for table user", Hint: "ask"},
+            errorResponse{Status: http.StatusForbidden, Code: "42501", Message: "permission denied for table user", Hint: "ask"},
+        },
+        {
+            // a server error's detail and hint aren't sent
+            "internal_error",
+            &pgconn.PgError{Code: "XX000", Message: "could not read block 0", Detail: "in /var/lib/postgresql", Hint: "check the disk"},
+            errorResponse{Status: http.StatusInternalServerError, Code: "XX000", Message: "could not read block 0"},
+        },
+        {
+            // only PostgreSQL's messages are passed on
+            "not from postgres",
+            errors.New("dial tcp 10.0.0.1:5432: connection refused"),
+            errorResponse{Status: http.StatusInternalServerError, Message: http.StatusText(http.StatusInternalServerError)},
+        },
+    }
+    for _, test := range tests {
+        w := httptest.NewRecorder()
+        writeError(w, test.err)
+
+        if w.Code != test.want.Status {
+            t.Errorf("%s: status %d, want %d", test.name, w.Code, test.want.Status)
+        }
+        if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+            t.Errorf("%s: Content-Type %q, want application/json", test.name, contentType)
+        }
+        var body errorResponse
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+            t.Fatalf("%s: body %q: %v", test.name, w.Body.String(), err)
+        }
+        if body != test.want {
+            t.Errorf("%s: body %+v, want %+v", test.name, body, test.want)
+        }
+    }
+}
@@ -48,15 +48,22 @@ create table endpoint."resource_binary" (
     path text not null,
     mimetype_id uuid not null references endpoint.mimetype(id) on delete restrict on update cascade,
     active boolean default true,
-    content bytea not null
+    content bytea not null,
+    cache_control text, -- Cache-Control header to send, e.g. 'public, max-age=31536000, immutable'.  null revalidates every time
+    modified timestamptz not null default now() -- sent as Last-Modified, set_modified() moves it on update
 );
+-- the server streams content with substring(), which only reads the part it
+-- asks for from uncompressed storage.  Images and video are compressed already.
+alter table endpoint.resource_binary alter column content set storage external;
 
 create table endpoint.resource (
     id uuid not null default public.uuid_generate_v4() primary key,
     path text not null,
     mimetype_id uuid not null references mimetype(id) on delete restrict on update cascade,
     active boolean default true,
-    content text not null default ''
+    content text not null default '',
+    cache_control text, -- Cache-Control header to send, e.g. 'public, max-age=31536000, immutable'.  null revalidates every time
+    modified timestamptz not null default now() -- sent as Last-Modified, set_modified() moves it on update
 );
 
 
@@ -85,11 +92,48 @@ create table endpoint.resource_function (
     mimetype_id uuid references mimetype(id) -- if this function always returns the same mimetype, set this
 );
 
+/******************************************************************************
+ * resource modified
+ * Moves modified to now() on every update to a resource, unless the update
+ * sets it itself, like a bundle checkout does.
+ ******************************************************************************/
+
+create function endpoint.set_modified() returns trigger as $$
+begin
+    if new.modified is not distinct from old.modified then
+        new.modified := now();
+    end if;
+    return new;
+end;
+$$ language plpgsql;
+
+create trigger resource_modified before update on endpoint.resource for each row execute procedure endpoint.set_modified();
+create trigger resource_binary_modified before update on endpoint.resource_binary for each row execute procedure endpoint.set_modified();
+
+/******************************************************************************
+ * route change notification
+ * The server keeps the paths and path_patterns of the resource tables (and
+ * template_route.url_pattern, below) in memory, and reloads them when these
+ * triggers notify it of a change.
+ ******************************************************************************/
+
+create function endpoint.notify_route_change() returns trigger as $$
+begin
+    perform pg_notify('endpoint_routes', tg_table_name);
+    return null;
+end;
+$$ language plpgsql;
+
+create trigger resource_route_change after insert or update or delete or truncate on endpoint.resource for each statement execute procedure endpoint.notify_route_change();
+create trigger resource_binary_route_change after insert or update or delete or truncate on endpoint.resource_binary for each statement execute procedure endpoint.notify_route_change();
+create trigger resource_function_route_change after insert or update of path_pattern or delete or truncate on endpoint.resource_function for each statement execute procedure endpoint.notify_route_change();
+
 /******************************************************************************
  * templates
  * - dynamic HTML fragments, parsed and rendered upon request.
  * - could possibly be non-HTML fragments as well.
- * FIXME: UNUSED, refactor w/ resource_function and/or remove???
+ * - served by the server for each path template_route.url_pattern matches,
+ *   rendered by endpoint.template_render(template_id, route_args, url_args)
  ******************************************************************************/
 
 create table endpoint.template (
@@ -106,6 +150,8 @@ create table endpoint.template_route (
     args text not null default '{}' -- this route's static arguments to be passed into the template
 );
 
+create trigger template_route_route_change after insert or update of url_pattern or delete or truncate on endpoint.template_route for each statement execute procedure endpoint.notify_route_change();
+
 
 
 
@@ -176,7 +222,7 @@ create or replace function endpoint.user_insert() returns trigger as $$
         -- If a role_id is supplied (thus not generated), make sure this role does not exist
         select exists(select 1 from meta.role where id = NEW.role_id) into role_exists;
         if role_exists then
-            raise exception 'Role already exists';
+            raise exception 'Role already exists' using errcode = 'duplicate_object';
         end if;
 
         -- Create a new role
@@ -200,7 +246,7 @@ create or replace function endpoint.user_update() returns trigger as $$
             -- If a role_id is supplied (thus not generated), make sure this role does not exist
             select exists(select 1 from meta.role where id = NEW.role_id) into role_exists;
             if role_exists then
-                raise exception 'Role already exists';
+                raise exception 'Role already exists' using errcode = 'duplicate_object';
             end if;
 
             -- Delete old role
@@ -12,7 +12,7 @@ DO
 $$
 begin
    -- anonymous
-   if not exists (select from pg_catalog.pg_roles where rolname = 'user') then
+   if not exists (select from pg_catalog.pg_roles where rolname = 'anonymous') then
       create role "anonymous" login;
    end if;
 
@@ -22,3 +22,18 @@ begin
    end if;
 end
 $$;
+
+/******************************************************************************
+ * anonymous
+ * The server runs requests without a session as anonymous, so it can read
+ * the routes and what they serve, and the meta catalog endpoint.request()
+ * looks rows and functions up in.  Everything else is up to each table's own
+ * grants.
+ ******************************************************************************/
+grant usage on schema endpoint to anonymous;
+grant select on endpoint.mimetype, endpoint.mimetype_extension, endpoint.column_mimetype to anonymous;
+grant select on endpoint.resource, endpoint.resource_binary, endpoint.resource_function to anonymous;
+grant select on endpoint.template, endpoint.template_route to anonymous;
+
+grant usage on schema meta to anonymous;
+grant select on all tables in schema meta to anonymous;
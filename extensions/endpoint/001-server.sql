@@ -1582,12 +1582,12 @@ as $$
           -- a. non-matching code
         execute 'select * from endpoint.user where email=' || quote_literal(_email) || ' and activation_code=' || quote_literal(_confirmation_code) into _user_row;
         if _user_row is null then
-            raise exception 'Invalid confirmation code';
+            raise exception 'Invalid confirmation code' using errcode = 'invalid_authorization_specification';
         end if;
 
           -- b. already active user
         if _user_row.active then
-            raise exception 'User already activated';
+            raise exception 'User already activated' using errcode = 'unique_violation';
         end if;
 
 
@@ -1656,36 +1656,83 @@ as $$
 $$;
 */
 
+/******************************************************************************
+ * endpoint.password_matches
+ * Checks a password against a role's rolpassword, md5 or SCRAM-SHA-256 (the
+ * default since PostgreSQL 14).  SCRAM's SaltedPassword is PBKDF2 with
+ * HMAC-SHA-256 (RFC 5802, 7677), so this computes it and compares the
+ * StoredKey.  PostgreSQL SASLprep-normalizes non-ASCII passwords first, which
+ * this doesn't, so a password that normalization changes won't match.
+ ******************************************************************************/
+
+create or replace function endpoint.password_matches (_password text, _role_name text, _rolpassword text) returns boolean
+    language plpgsql immutable strict
+as $$
+
+    declare
+        _scram text[];
+        _password_bytes bytea := convert_to(_password, 'UTF8');
+        _u bytea;
+        _salted bit(256);
+        _salted_password bytea := '';
+        _client_key bytea;
+
+    begin
+        -- md5: 'md5' || md5(password || role name)
+        if _rolpassword like 'md5%' then
+            return _rolpassword = 'md5' || md5(_password || _role_name);
+        end if;
+
+        -- SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+        select regexp_matches(_rolpassword, '^SCRAM-SHA-256\$(\d+):([^$]+)\$([^:]+):(.+)$') into _scram;
+        if _scram is null then
+            return false;
+        end if;
+
+        -- SaltedPassword: U1 = HMAC(password, salt || INT(1)), Ui = HMAC(password, Ui-1), xored together
+        _u := public.hmac(decode(_scram[2], 'base64') || '\x00000001'::bytea, _password_bytes, 'sha256');
+        _salted := ('x' || encode(_u, 'hex'))::bit(256);
+        for i in 2.._scram[1]::integer loop
+            _u := public.hmac(_u, _password_bytes, 'sha256');
+            _salted := _salted # ('x' || encode(_u, 'hex'))::bit(256);
+        end loop;
+        for i in 0..7 loop
+            _salted_password := _salted_password || decode(lpad(to_hex(substring(_salted from i * 32 + 1 for 32)::bit(32)::integer), 8, '0'), 'hex');
+        end loop;
+
+        -- StoredKey = H(HMAC(SaltedPassword, "Client Key"))
+        _client_key := public.hmac(convert_to('Client Key', 'UTF8'), _salted_password, 'sha256');
+        return public.digest(_client_key, 'sha256') = decode(_scram[3], 'base64');
+    end
+$$;
+
 /******************************************************************************
  * endpoint.login
  ******************************************************************************/
 
-/*
 create or replace function endpoint.login (_email text, _password text) returns uuid
     language plpgsql strict security definer
 as $$
 
     declare
         _role_name text;
-        _encrypted_password text;
+        _rolpassword text;
         _session_id uuid := null;
 
     begin
-        -- Build encrypted password by getting role name associated with this email
-        select 'md5' || md5(_password || (role_id).name) from endpoint.user where email=_email into _encrypted_password;
+        -- Get the role name associated with this email
+        select (role_id).name from endpoint.user where email=_email into _role_name;
 
         -- Email does not exists in endpoint.user table
-        if _encrypted_password is null then
-            raise exception 'No user with this email';
+        if _role_name is null then
+            raise exception 'No user with this email' using errcode = 'invalid_authorization_specification';
         end if;
 
-        -- Look for role with this password
-        execute 'select rolname from pg_catalog.pg_authid where rolpassword = ' || quote_literal(_encrypted_password) into _role_name;
-
-        -- _role_name is null if rolpassword does not exist in pg_catalog.pg_auth_id table -- invalid password
+        -- _rolpassword is null if the role has no password, which never matches
+        select rolpassword from pg_catalog.pg_authid where rolname = _role_name into _rolpassword;
 
         -- Create cookie session for this role/user
-        if _role_name is not null then
+        if endpoint.password_matches(_password, _role_name, _rolpassword) then
             insert into endpoint.session (role_id, user_id)values (meta.role_id(_role_name), (select id from endpoint.user where email=_email))returning id into _session_id;
         end if;
 
@@ -1693,20 +1740,20 @@ as $$
         return _session_id;
     end
 $$;
-*/
+
+-- the server calls it as its own role, this is for anonymous SQL clients
+grant execute on function endpoint.login(text, text) to anonymous;
 
 /******************************************************************************
  * endpoint.logout
  ******************************************************************************/
 
-/*
 create or replace function endpoint.logout (_email text) returns void
     language sql strict security definer
 as $$
     -- Should this delete all sessions associated with this user? I think so
     delete from endpoint.session where user_id = (select id from endpoint."user" where email = _email);
 $$;
-*/
 
 /******************************************************************************
  * endpoint.superuser
@@ -1782,60 +1829,79 @@ $$ language sql;
 /*******************************************************************************
  * FUNCTION template_render
  * Renders a template
+ *
+ * Templates are doT.js templates, rendered with `it` set to route_args plus
+ * it.url_args.  Only interpolation is rendered here:
+ *   {{= it.name }}          the value, as is
+ *   {{! it.url_args[0] }}   the value, HTML-encoded
+ * Any other {{ }} tag is an error rather than being passed through.
  *******************************************************************************/
 
-/*
 create or replace function endpoint.template_render(
     template_id uuid,
     route_args json default '{}', -- these are the args passed in from the template_route record
     url_args json default '[]' -- these are args that matched a regex part in parentheses
 ) returns text as $$
-    // fetch the template
-    var template;
-    try {
-        var template_rows = plv8.execute('select * from endpoint.template where id=$1', [ template_id ]);
-        template_row = template_rows[0];
-        plv8.elog(NOTICE, ' template is ' + template_row.id);
-    }
-    catch( e ) {
-        plv8.elog( ERROR, e, e);
-        return false;
-    }
-    plv8.elog(NOTICE, 'template '+template_row.name+' called with route_args '+JSON.stringify(route_args)+', url_args'+JSON.stringify(url_args));
-
-    // setup javascript scope
-    var context = {};
-    // url_args is an array of vals extracted from the matching url_pattern
-    context.url_args = url_args;
-    // route_args is an object passed in from template_route.args json
-    for (var key in route_args) { context[key] = route_args[key]; }
-    plv8.elog(NOTICE, 'context set to '+JSON.stringify(context));
-
-    // doT.js
-    var doT_rows = plv8.execute("select * from endpoint.js_module where name='doT'");
-    eval( doT_rows[0].code );
-    // context.doT = doT;
-
-
-    plv8.elog(NOTICE, 'done with doT');
-
-    // aquameta-template-plv8
-    var aq_template = plv8.execute("select * from endpoint.js_module where name='aquameta-template-plv8'");
-    eval( aq_template[0].code );
-    // import template() funciton into context, so doT can see it
-    context.template = AQ.Template.template;
-    plv8.elog(NOTICE, 'done with template: '+template_row.id);
-
-
-    // render the template
-    var htmlTemplate = doT.template(template_row.content);
-    var html = htmlTemplate(context);
-    plv8.elog(NOTICE, 'html = '+html);
-
-    return html;
-$$ language plv8;
+declare
+    template_row endpoint.template;
+    context jsonb;
+    rest text;
+    html text := '';
+    tag text;
+    tag_parts text[];
+    value text;
+    i integer;
+begin
+    -- fetch the template
+    select * into template_row from endpoint.template t where t.id = template_render.template_id;
+    if not found then
+        raise exception 'endpoint.template % does not exist', template_id using errcode = 'no_data_found';
+    end if;
 
-*/
+    -- setup the template's scope
+    context := coalesce(route_args::jsonb, '{}');
+    if jsonb_typeof(context) != 'object' then
+        context := '{}';
+    end if;
+    context := context || jsonb_build_object('url_args', coalesce(url_args::jsonb, '[]'));
+
+    -- render the template
+    rest := template_row.content;
+    loop
+        i := position('{{' in rest);
+        exit when i = 0;
+        html := html || left(rest, i - 1);
+        rest := substr(rest, i + 2);
+
+        i := position('}}' in rest);
+        if i = 0 then
+            raise exception 'endpoint.template %: unterminated {{', template_row.name;
+        end if;
+        tag := substr(rest, 1, i - 1);
+        rest := substr(rest, i + 2);
+
+        -- {{= it.a.b[0] }} or {{! it.a.b[0] }}
+        tag_parts := regexp_match(tag, '^\s*([=!])\s*it((\.[A-Za-z_$][A-Za-z0-9_$]*|\[[0-9]+\])*)\s*$');
+        if tag_parts is null then
+            raise exception 'endpoint.template %: {{%}} is not supported, only {{= it.x }} and {{! it.x }}', template_row.name, tag
+                using errcode = 'feature_not_supported';
+        end if;
+
+        value := coalesce(context #>> array(
+            select coalesce(p[1], p[2])
+            from regexp_matches(tag_parts[2], '\.([A-Za-z_$][A-Za-z0-9_$]*)|\[([0-9]+)\]', 'g') p
+        ), '');
+
+        if tag_parts[1] = '!' then
+            value := replace(replace(replace(replace(replace(replace(value,
+                '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;'), '/', '&#47;');
+        end if;
+        html := html || value;
+    end loop;
+
+    return html || rest;
+end;
+$$ language plpgsql stable;
 
 
 /*******************************************************************************
@@ -0,0 +1,228 @@
+/******************************************************************************
+ * endpoint 0.5.0 -> 0.5.1
+ * - route change notification, for the server's in-memory route table
+ * - resource and resource_binary cache_control and modified
+ * - uncompressed resource_binary content, for streaming with substring()
+ * - template_render(), in plpgsql
+ * - login() and logout(), which 0.5.0 had commented out, with SCRAM passwords
+ * - anonymous's grants
+ ******************************************************************************/
+
+/******************************************************************************
+ * route change notification
+ * 000-data-model.sql creates these for new installs.  Without them, the
+ * server matches routes in the database.
+ ******************************************************************************/
+
+create function endpoint.notify_route_change() returns trigger as $$
+begin
+    perform pg_notify('endpoint_routes', tg_table_name);
+    return null;
+end;
+$$ language plpgsql;
+
+create trigger resource_route_change after insert or update or delete or truncate on endpoint.resource for each statement execute procedure endpoint.notify_route_change();
+create trigger resource_binary_route_change after insert or update or delete or truncate on endpoint.resource_binary for each statement execute procedure endpoint.notify_route_change();
+create trigger resource_function_route_change after insert or update of path_pattern or delete or truncate on endpoint.resource_function for each statement execute procedure endpoint.notify_route_change();
+create trigger template_route_route_change after insert or update of url_pattern or delete or truncate on endpoint.template_route for each statement execute procedure endpoint.notify_route_change();
+
+alter table endpoint.resource add column cache_control text;
+alter table endpoint.resource_binary add column cache_control text;
+
+-- existing rows start out modified as of the upgrade
+alter table endpoint.resource add column modified timestamptz not null default now();
+alter table endpoint.resource_binary add column modified timestamptz not null default now();
+
+create function endpoint.set_modified() returns trigger as $$
+begin
+    if new.modified is not distinct from old.modified then
+        new.modified := now();
+    end if;
+    return new;
+end;
+$$ language plpgsql;
+
+create trigger resource_modified before update on endpoint.resource for each row execute procedure endpoint.set_modified();
+create trigger resource_binary_modified before update on endpoint.resource_binary for each row execute procedure endpoint.set_modified();
+
+-- only new and updated content is stored uncompressed
+alter table endpoint.resource_binary alter column content set storage external;
+
+create or replace function endpoint.template_render(
+    template_id uuid,
+    route_args json default '{}', -- these are the args passed in from the template_route record
+    url_args json default '[]' -- these are args that matched a regex part in parentheses
+) returns text as $$
+declare
+    template_row endpoint.template;
+    context jsonb;
+    rest text;
+    html text := '';
+    tag text;
+    tag_parts text[];
+    value text;
+    i integer;
+begin
+    -- fetch the template
+    select * into template_row from endpoint.template t where t.id = template_render.template_id;
+    if not found then
+        raise exception 'endpoint.template % does not exist', template_id using errcode = 'no_data_found';
+    end if;
+
+    -- setup the template's scope
+    context := coalesce(route_args::jsonb, '{}');
+    if jsonb_typeof(context) != 'object' then
+        context := '{}';
+    end if;
+    context := context || jsonb_build_object('url_args', coalesce(url_args::jsonb, '[]'));
+
+    -- render the template
+    rest := template_row.content;
+    loop
+        i := position('{{' in rest);
+        exit when i = 0;
+        html := html || left(rest, i - 1);
+        rest := substr(rest, i + 2);
+
+        i := position('}}' in rest);
+        if i = 0 then
+            raise exception 'endpoint.template %: unterminated {{', template_row.name;
+        end if;
+        tag := substr(rest, 1, i - 1);
+        rest := substr(rest, i + 2);
+
+        -- {{= it.a.b[0] }} or {{! it.a.b[0] }}
+        tag_parts := regexp_match(tag, '^\s*([=!])\s*it((\.[A-Za-z_$][A-Za-z0-9_$]*|\[[0-9]+\])*)\s*$');
+        if tag_parts is null then
+            raise exception 'endpoint.template %: {{%}} is not supported, only {{= it.x }} and {{! it.x }}', template_row.name, tag
+                using errcode = 'feature_not_supported';
+        end if;
+
+        value := coalesce(context #>> array(
+            select coalesce(p[1], p[2])
+            from regexp_matches(tag_parts[2], '\.([A-Za-z_$][A-Za-z0-9_$]*)|\[([0-9]+)\]', 'g') p
+        ), '');
+
+        if tag_parts[1] = '!' then
+            value := replace(replace(replace(replace(replace(replace(value,
+                '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;'), '/', '&#47;');
+        end if;
+        html := html || value;
+    end loop;
+
+    return html || rest;
+end;
+$$ language plpgsql stable;
+
+/******************************************************************************
+ * endpoint.password_matches
+ * Checks a password against a role's rolpassword, md5 or SCRAM-SHA-256 (the
+ * default since PostgreSQL 14).  SCRAM's SaltedPassword is PBKDF2 with
+ * HMAC-SHA-256 (RFC 5802, 7677), so this computes it and compares the
+ * StoredKey.  PostgreSQL SASLprep-normalizes non-ASCII passwords first, which
+ * this doesn't, so a password that normalization changes won't match.
+ ******************************************************************************/
+
+create or replace function endpoint.password_matches (_password text, _role_name text, _rolpassword text) returns boolean
+    language plpgsql immutable strict
+as $$
+
+    declare
+        _scram text[];
+        _password_bytes bytea := convert_to(_password, 'UTF8');
+        _u bytea;
+        _salted bit(256);
+        _salted_password bytea := '';
+        _client_key bytea;
+
+    begin
+        -- md5: 'md5' || md5(password || role name)
+        if _rolpassword like 'md5%' then
+            return _rolpassword = 'md5' || md5(_password || _role_name);
+        end if;
+
+        -- SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+        select regexp_matches(_rolpassword, '^SCRAM-SHA-256\$(\d+):([^$]+)\$([^:]+):(.+)$') into _scram;
+        if _scram is null then
+            return false;
+        end if;
+
+        -- SaltedPassword: U1 = HMAC(password, salt || INT(1)), Ui = HMAC(password, Ui-1), xored together
+        _u := public.hmac(decode(_scram[2], 'base64') || '\x00000001'::bytea, _password_bytes, 'sha256');
+        _salted := ('x' || encode(_u, 'hex'))::bit(256);
+        for i in 2.._scram[1]::integer loop
+            _u := public.hmac(_u, _password_bytes, 'sha256');
+            _salted := _salted # ('x' || encode(_u, 'hex'))::bit(256);
+        end loop;
+        for i in 0..7 loop
+            _salted_password := _salted_password || decode(lpad(to_hex(substring(_salted from i * 32 + 1 for 32)::bit(32)::integer), 8, '0'), 'hex');
+        end loop;
+
+        -- StoredKey = H(HMAC(SaltedPassword, "Client Key"))
+        _client_key := public.hmac(convert_to('Client Key', 'UTF8'), _salted_password, 'sha256');
+        return public.digest(_client_key, 'sha256') = decode(_scram[3], 'base64');
+    end
+$$;
+
+create or replace function endpoint.login (_email text, _password text) returns uuid
+    language plpgsql strict security definer
+as $$
+
+    declare
+        _role_name text;
+        _rolpassword text;
+        _session_id uuid := null;
+
+    begin
+        -- Get the role name associated with this email
+        select (role_id).name from endpoint.user where email=_email into _role_name;
+
+        -- Email does not exists in endpoint.user table
+        if _role_name is null then
+            raise exception 'No user with this email' using errcode = 'invalid_authorization_specification';
+        end if;
+
+        -- _rolpassword is null if the role has no password, which never matches
+        select rolpassword from pg_catalog.pg_authid where rolname = _role_name into _rolpassword;
+
+        -- Create cookie session for this role/user
+        if endpoint.password_matches(_password, _role_name, _rolpassword) then
+            insert into endpoint.session (role_id, user_id)values (meta.role_id(_role_name), (select id from endpoint.user where email=_email))returning id into _session_id;
+        end if;
+
+        -- Return cookie
+        return _session_id;
+    end
+$$;
+
+create or replace function endpoint.logout (_email text) returns void
+    language sql strict security definer
+as $$
+    -- Should this delete all sessions associated with this user? I think so
+    delete from endpoint.session where user_id = (select id from endpoint."user" where email = _email);
+$$;
+
+/******************************************************************************
+ * anonymous
+ * 000-roles.sql in 0.5.0 only created anonymous if "user" didn't exist yet.
+ * Requests without a session run as anonymous, so it needs the same grants
+ * new installs give it.
+ ******************************************************************************/
+do $$
+begin
+    if not exists (select from pg_catalog.pg_roles where rolname = 'anonymous') then
+        create role "anonymous" login;
+    end if;
+end
+$$;
+
+grant usage on schema endpoint to anonymous;
+grant select on endpoint.mimetype, endpoint.mimetype_extension, endpoint.column_mimetype to anonymous;
+grant select on endpoint.resource, endpoint.resource_binary, endpoint.resource_function to anonymous;
+grant select on endpoint.template, endpoint.template_route to anonymous;
+
+grant usage on schema meta to anonymous;
+grant select on all tables in schema meta to anonymous;
+
+-- the server calls it as its own role, this is for anonymous SQL clients
+grant execute on function endpoint.login(text, text) to anonymous;
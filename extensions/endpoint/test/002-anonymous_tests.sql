@@ -0,0 +1,65 @@
+begin;
+
+create extension if not exists pgtap schema public;
+set search_path=public,meta;
+
+select * from no_plan();
+
+insert into endpoint.resource (path, mimetype_id, content)
+values ('/endpoint-test-anonymous', (select id from endpoint.mimetype where mimetype='text/html'), 'public');
+
+-------------------------------------------------------------------------------
+-- TEST 1: anonymous can read resources
+-------------------------------------------------------------------------------
+set local role anonymous;
+
+select is (
+    (select content from endpoint.resource r join endpoint.mimetype m on r.mimetype_id = m.id where path = '/endpoint-test-anonymous'),
+    'public',
+    'anonymous can read a resource and its mimetype'
+);
+select lives_ok (
+    'select count(*) from endpoint.resource_binary, endpoint.resource_function, endpoint.template_route, endpoint.template',
+    'anonymous can read the other routes'
+);
+select lives_ok (
+    'select count(*) from meta.function',
+    'anonymous can read meta.function'
+);
+
+reset role;
+
+-------------------------------------------------------------------------------
+-- TEST 2: password_matches
+-------------------------------------------------------------------------------
+set local password_encryption = 'md5';
+create role endpoint_test_md5 login password 'md5 secret';
+set local password_encryption = 'scram-sha-256';
+create role endpoint_test_scram login password 'scram secret';
+
+select ok (
+    endpoint.password_matches('md5 secret', 'endpoint_test_md5', (select rolpassword from pg_catalog.pg_authid where rolname = 'endpoint_test_md5')),
+    'password_matches an md5 password'
+);
+select ok (
+    endpoint.password_matches('scram secret', 'endpoint_test_scram', (select rolpassword from pg_catalog.pg_authid where rolname = 'endpoint_test_scram')),
+    'password_matches a SCRAM password'
+);
+select ok (
+    not endpoint.password_matches('md5 secret!', 'endpoint_test_md5', (select rolpassword from pg_catalog.pg_authid where rolname = 'endpoint_test_md5')),
+    'password_matches rejects a wrong md5 password'
+);
+select ok (
+    not endpoint.password_matches('scram secret!', 'endpoint_test_scram', (select rolpassword from pg_catalog.pg_authid where rolname = 'endpoint_test_scram')),
+    'password_matches rejects a wrong SCRAM password'
+);
+
+-------------------------------------------------------------------------------
+-- TEST 3: login with a SCRAM password
+-------------------------------------------------------------------------------
+insert into endpoint.user (role_id, email) values (meta.role_id('endpoint_test_scram'), 'scram@example.com');
+
+select isnt (endpoint.login('scram@example.com', 'scram secret'), null, 'login with a SCRAM password starts a session');
+select is (endpoint.login('scram@example.com', 'wrong'), null, 'login with the wrong password does not');
+
+rollback;
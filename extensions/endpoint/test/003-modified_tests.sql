@@ -0,0 +1,33 @@
+begin;
+
+create extension if not exists pgtap schema public;
+set search_path=public,meta;
+
+select * from no_plan();
+
+insert into endpoint.resource (path, mimetype_id, content, modified)
+values ('/endpoint-test-modified', (select id from endpoint.mimetype where mimetype='text/html'), 'before', '2021-03-04 05:06:07+00');
+
+-------------------------------------------------------------------------------
+-- TEST 1: an update moves modified
+-------------------------------------------------------------------------------
+update endpoint.resource set content = 'after' where path = '/endpoint-test-modified';
+
+select is (
+    (select modified from endpoint.resource where path = '/endpoint-test-modified'),
+    now(),
+    'an update moves modified to now()'
+);
+
+-------------------------------------------------------------------------------
+-- TEST 2: an update that sets modified keeps it
+-------------------------------------------------------------------------------
+update endpoint.resource set content = 'checked out', modified = '2021-03-04 05:06:07+00' where path = '/endpoint-test-modified';
+
+select is (
+    (select modified from endpoint.resource where path = '/endpoint-test-modified'),
+    '2021-03-04 05:06:07+00'::timestamptz,
+    'an update that sets modified keeps it'
+);
+
+rollback;
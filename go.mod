@@ -7,6 +7,7 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/aquametalabs/embedded-postgres v1.3.1-0.20201217152936-199af027a188
 	github.com/googollee/go-socket.io v1.6.1
+	github.com/jackc/pgconn v1.13.0
 	github.com/jackc/pgx/v4 v4.17.2
 	github.com/lib/pq v1.10.2
 	github.com/webview/webview v0.0.0-20200724072439-e0c01595b361
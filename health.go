@@ -0,0 +1,250 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "github.com/jackc/pgx/v4/pgxpool"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// how long /_health/ready waits on the database before reporting it down
+const healthTimeout = 2 * time.Second
+
+// PGFS's mount state: disabled, mounting, mounted, failed, stopped or
+// unsupported, set by pgfs()
+var pgfsState = "disabled"
+var pgfsStateMu sync.Mutex
+
+func setPGFSState(state string) {
+    pgfsStateMu.Lock()
+    pgfsState = state
+    pgfsStateMu.Unlock()
+}
+
+func getPGFSState() string {
+    pgfsStateMu.Lock()
+    defer pgfsStateMu.Unlock()
+    return pgfsState
+}
+
+// serverHealth follows serve() through its states, so /_health/ready can
+// answer from before the database is up: starting, installing, serving and
+// stopping.  Only once it's serving are the pools and the rest checked.
+type serverHealth struct {
+    mu sync.Mutex
+    state string
+    pools map[string]*pgxpool.Pool
+    routes *routeTable
+    listener *eventListener
+}
+
+func newServerHealth() *serverHealth {
+    return &serverHealth{state: "starting"}
+}
+
+func (h *serverHealth) setState(state string) {
+    h.mu.Lock()
+    h.state = state
+    h.mu.Unlock()
+}
+
+// serving hands over what readiness checks and moves to serving.
+func (h *serverHealth) serving(pools map[string]*pgxpool.Pool, routes *routeTable, listener *eventListener) {
+    h.mu.Lock()
+    h.pools, h.routes, h.listener = pools, routes, listener
+    h.state = "serving"
+    h.mu.Unlock()
+}
+
+func (h *serverHealth) get() (string, map[string]*pgxpool.Pool, *routeTable, *eventListener) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.state, h.pools, h.routes, h.listener
+}
+
+// startupHealth is the JSON body of /_health/ready until the server is
+// serving.
+type startupHealth struct {
+    Ready bool `json:"ready"`
+    State string `json:"state"`
+}
+
+// readiness is the JSON body of /_health/ready once the server is serving.
+// Errors are logged rather than passed on, since the endpoint needs no login.
+type readiness struct {
+    Ready bool `json:"ready"`
+    State string `json:"state"`
+    Pools map[string]poolHealth `json:"pools"`
+    Install installHealth `json:"install"`
+    Listener listenerHealth `json:"listener"`
+    Routes routesHealth `json:"routes"`
+    PGFS pgfsHealth `json:"pgfs"`
+}
+
+type poolHealth struct {
+    OK bool `json:"ok"`
+    TotalConns int32 `json:"totalConns"`
+    IdleConns int32 `json:"idleConns"`
+    AcquiredConns int32 `json:"acquiredConns"`
+    MaxConns int32 `json:"maxConns"`
+}
+
+type installHealth struct {
+    OK bool `json:"ok"`
+    Missing []string `json:"missing,omitempty"`      // extensions not installed
+    Outdated []string `json:"outdated,omitempty"`    // extensions not at the version this server expects
+}
+
+type listenerHealth struct {
+    OK bool `json:"ok"`          // the socket.io event LISTEN goroutine is running
+}
+
+// the route table is only reported, resource() matches in the database while
+// it isn't usable
+type routesHealth struct {
+    Cached bool `json:"cached"`
+    Paths int `json:"paths"`
+    Patterns int `json:"patterns"`
+}
+
+type pgfsHealth struct {
+    OK bool `json:"ok"`
+    State string `json:"state"`
+}
+
+// healthLive handles /_health/live: the process is up and serving HTTP.
+func healthLive(w http.ResponseWriter, req *http.Request) {
+    writeHealth(w, http.StatusOK, map[string]bool{"live": true})
+}
+
+// ready handles /_health/ready: the server is serving, every pool has a
+// working connection, the extensions are installed, the event listener is
+// running and PGFS is mounted if it's enabled.  It answers 503 if any of them
+// isn't.
+func (h *serverHealth) ready(w http.ResponseWriter, req *http.Request) {
+    state, pools, routes, listener := h.get()
+    if state != "serving" {
+        writeHealth(w, http.StatusServiceUnavailable, startupHealth{State: state})
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(req.Context(), healthTimeout)
+    defer cancel()
+
+    r := readiness{Ready: true, State: state, Pools: make(map[string]poolHealth)}
+
+    // pools
+    for name, pool := range pools {
+        if pool == nil {
+            continue
+        }
+        stat := pool.Stat()
+        health := poolHealth{
+            OK: true,
+            TotalConns: stat.TotalConns(),
+            IdleConns: stat.IdleConns(),
+            AcquiredConns: stat.AcquiredConns(),
+            MaxConns: stat.MaxConns(),
+        }
+        if err := pingPool(ctx, pool); err != nil {
+            log.Printf("Health check: %s pool: %v", name, err)
+            health.OK = false
+            r.Ready = false
+        }
+        r.Pools[name] = health
+    }
+
+    // install
+    r.Install = checkExtensions(ctx, pools["http"])
+    if !r.Install.OK {
+        r.Ready = false
+    }
+
+    // event listener
+    r.Listener.OK = listener.running()
+    if !r.Listener.OK {
+        r.Ready = false
+    }
+
+    // route table
+    r.Routes.Paths, r.Routes.Patterns, r.Routes.Cached = routes.stats()
+
+    // pgfs
+    r.PGFS.State = getPGFSState()
+    switch r.PGFS.State {
+    case "disabled", "mounted", "unsupported":
+        r.PGFS.OK = true
+    default:
+        r.Ready = false
+    }
+
+    status := http.StatusOK
+    if !r.Ready {
+        status = http.StatusServiceUnavailable
+    }
+    writeHealth(w, status, r)
+}
+
+// pingPool checks that the pool can hand out a connection that works.
+func pingPool(ctx context.Context, pool *pgxpool.Pool) error {
+    conn, err := pool.Acquire(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Release()
+    return conn.Conn().Ping(ctx)
+}
+
+// checkExtensions compares the installed extensions against the ones this
+// server expects, in a single query.
+func checkExtensions(ctx context.Context, pool *pgxpool.Pool) installHealth {
+    var health installHealth
+
+    var names []string
+    for _, ext := range extensions {
+        names = append(names, ext.Name)
+    }
+
+    rows, err := pool.Query(ctx, "select extname, extversion from pg_catalog.pg_extension where extname = any($1)", names)
+    if err != nil {
+        log.Printf("Health check: extensions: %v", err)
+        return health
+    }
+    installed := make(map[string]string)
+    for rows.Next() {
+        var name, version string
+        if err := rows.Scan(&name, &version); err != nil {
+            rows.Close()
+            log.Printf("Health check: extensions: %v", err)
+            return health
+        }
+        installed[name] = version
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        log.Printf("Health check: extensions: %v", err)
+        return health
+    }
+
+    for _, ext := range extensions {
+        version, ok := installed[ext.Name]
+        if !ok {
+            health.Missing = append(health.Missing, ext.Name)
+        } else if ext.Version != "" && version != ext.Version {
+            health.Outdated = append(health.Outdated, ext.Name)
+        }
+    }
+    // outdated extensions still work, serve() only warns about them
+    health.OK = len(health.Missing) == 0
+    return health
+}
+
+func writeHealth(w http.ResponseWriter, status int, body interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(body)
+}
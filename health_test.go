@@ -0,0 +1,89 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "github.com/jackc/pgx/v4/pgxpool"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestHealthLive(t *testing.T) {
+    w := httptest.NewRecorder()
+    healthLive(w, httptest.NewRequest("GET", "/_health/live", nil))
+
+    if w.Code != http.StatusOK {
+        t.Errorf("status %d, want 200", w.Code)
+    }
+    for name, want := range map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"} {
+        if got := w.Header().Get(name); got != want {
+            t.Errorf("%s %q, want %q", name, got, want)
+        }
+    }
+    if body := w.Body.String(); body != "{\"live\":true}\n" {
+        t.Errorf("body %q", body)
+    }
+}
+
+func TestHealthReadyState(t *testing.T) {
+    tests := []struct {
+        state string
+        body string
+    }{
+        {"starting", "{\"ready\":false,\"state\":\"starting\"}\n"},
+        {"installing", "{\"ready\":false,\"state\":\"installing\"}\n"},
+        {"stopping", "{\"ready\":false,\"state\":\"stopping\"}\n"},
+    }
+    for _, test := range tests {
+        health := newServerHealth()
+        health.setState(test.state)
+
+        w := httptest.NewRecorder()
+        health.ready(w, httptest.NewRequest("GET", "/_health/ready", nil))
+
+        if w.Code != http.StatusServiceUnavailable {
+            t.Errorf("%s: status %d, want 503", test.state, w.Code)
+        }
+        if body := w.Body.String(); body != test.body {
+            t.Errorf("%s: body %q, want %q", test.state, body, test.body)
+        }
+    }
+}
+
+func TestHealthReadyHidesErrors(t *testing.T) {
+    // nothing listens on port 1, the pool only finds out when pinged
+    poolConfig, err := pgxpool.ParseConfig("postgres://aquameta@127.0.0.1:1/aquameta?connect_timeout=1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    poolConfig.LazyConnect = true
+    pool, err := pgxpool.ConnectConfig(context.Background(), poolConfig)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer pool.Close()
+
+    health := newServerHealth()
+    health.serving(map[string]*pgxpool.Pool{"http": pool}, nil, nil)
+
+    w := httptest.NewRecorder()
+    health.ready(w, httptest.NewRequest("GET", "/_health/ready", nil))
+
+    if w.Code != http.StatusServiceUnavailable {
+        t.Errorf("status %d, want 503", w.Code)
+    }
+    var r readiness
+    if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+        t.Fatalf("body %q: %v", w.Body.String(), err)
+    }
+    if r.State != "serving" || r.Pools["http"].OK {
+        t.Errorf("body %+v, want serving with the http pool down", r)
+    }
+    for _, leak := range []string{"127.0.0.1", "refused", "dial"} {
+        if strings.Contains(w.Body.String(), leak) {
+            t.Errorf("body %q passes on %q", w.Body.String(), leak)
+        }
+    }
+}
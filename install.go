@@ -0,0 +1,343 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "github.com/jackc/pgx/v4/pgxpool"
+    "github.com/lib/pq"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+)
+
+// extension is a PostgreSQL extension the installer manages.
+type extension struct {
+    Name string
+    Version string    // empty for contrib extensions, which are installed at their default version
+    Schema string     // empty to use the schema from the extension's control file
+}
+
+// the extensions Aquameta needs, in dependency order
+var extensions = [...]extension{
+    {Name: "hstore", Schema: "public"},
+    {Name: "uuid-ossp", Schema: "public"},
+    // {Name: "pg_uuidv7", Schema: "public"},
+    {Name: "pgcrypto", Schema: "public"},
+    {Name: "postgres_fdw", Schema: "public"},
+    {Name: "meta", Version: "0.5.0"},
+    {Name: "meta_triggers", Version: "0.5.0"},
+    {Name: "pg_bundle", Version: "0.5.0"},
+    {Name: "event", Version: "0.5.0"},
+    {Name: "endpoint", Version: "0.5.1"},
+    {Name: "widget", Version: "0.5.0"},
+    {Name: "semantics", Version: "0.5.0"},
+    {Name: "ide", Version: "0.5.0"},
+    {Name: "documentation", Version: "0.5.0"},
+}
+
+// installStep records what the installer found, and did, for one item.
+type installStep struct {
+    Item string       // e.g. "extension meta", "bundle org.aquameta.core.ide"
+    Action string     // present, installed, repaired, upgraded, skipped, or "would ..." on a dry run
+    Detail string
+}
+
+type installReport []installStep
+
+// add appends a step, choosing the dry run wording for anything that would
+// change the database.
+func (r *installReport) add(dryRun bool, item string, action string, detail string) {
+    if dryRun {
+        switch action {
+        case "installed":
+            action = "would install"
+        case "repaired":
+            action = "would repair"
+        case "upgraded":
+            action = "would upgrade"
+        }
+    }
+    *r = append(*r, installStep{item, action, detail})
+}
+
+// Complete reports whether every item was already present.
+func (r installReport) Complete() bool {
+    for _, step := range r {
+        if step.Action != "present" {
+            return false
+        }
+    }
+    return true
+}
+
+func (r installReport) Log() {
+    for _, step := range r {
+        if step.Detail != "" {
+            log.Printf("  %-45s %s (%s)", step.Item, step.Action, step.Detail)
+        } else {
+            log.Printf("  %-45s %s", step.Item, step.Action)
+        }
+    }
+}
+
+// aquametaInstalled reports whether every extension, the superuser and every
+// core bundle is present on the database.
+func aquametaInstalled(config tomlConfig, dbpool *pgxpool.Pool, workingDirectory string) (bool, installReport, error) {
+    report, err := installAquameta(config, dbpool, workingDirectory, true)
+    if err != nil {
+        return false, report, err
+    }
+    return report.Complete(), report, nil
+}
+
+// installAquameta checks each extension, the superuser and each core bundle
+// individually, and installs or repairs only what is missing.  With dryRun, it
+// reports what it would do without changing anything.  It is safe to run
+// against a complete or a partially installed database.
+func installAquameta(config tomlConfig, dbpool *pgxpool.Pool, workingDirectory string, dryRun bool) (installReport, error) {
+    var report installReport
+    ctx := context.Background()
+
+    step := func(item string, action string, detail string) {
+        report.add(dryRun, item, action, detail)
+    }
+
+    //
+    // extensions
+    //
+    extensionFilesCopied := false
+    for _, ext := range extensions {
+        item := "extension " + ext.Name
+
+        var installedVersion string
+        var available bool
+        err := dbpool.QueryRow(ctx, `
+            select
+                coalesce((select extversion from pg_catalog.pg_extension where extname = $1), ''),
+                exists(select 1 from pg_catalog.pg_available_extensions where name = $1)`,
+            ext.Name).Scan(&installedVersion, &available)
+        if err != nil {
+            return report, fmt.Errorf("unable to check %s: %v", item, err)
+        }
+
+        if installedVersion != "" {
+            if ext.Version != "" && installedVersion != ext.Version {
+                step(item, "present", "version "+installedVersion+", expected "+ext.Version)
+            } else {
+                step(item, "present", "")
+            }
+            continue
+        }
+
+        // the extension's files are not in PostgreSQL's extension directory
+        if !available {
+            if config.Database.Mode != "embedded" {
+                if dryRun {
+                    step(item, "installed", "not available on the server")
+                    continue
+                }
+                return report, fmt.Errorf("%s is not available on the server; install it with scripts/make_install_extensions.sh", item)
+            }
+            if !dryRun && !extensionFilesCopied {
+                if err := copyExtensionFiles(workingDirectory, config.Database.EmbeddedPostgresRuntimePath); err != nil {
+                    return report, fmt.Errorf("unable to copy extension files: %v", err)
+                }
+                log.Print("Extensions copied to PostgreSQL's extensions directory.")
+                extensionFilesCopied = true
+            }
+        }
+
+        // utility statements can't take bind parameters
+        q := "create extension if not exists " + pq.QuoteIdentifier(ext.Name)
+        if ext.Schema != "" {
+            q += " schema " + pq.QuoteIdentifier(ext.Schema)
+        }
+        if ext.Version != "" {
+            q += " version " + pq.QuoteLiteral(ext.Version)
+        }
+
+        if !dryRun {
+            log.Print(q)
+            if _, err := dbpool.Exec(ctx, q); err != nil {
+                return report, fmt.Errorf("unable to install %s: %v", item, err)
+            }
+        }
+        step(item, "installed", ext.Version)
+    }
+
+    //
+    // setup hub remote
+    //
+    /*
+    log.Print("Adding bundle.remote_database for hub...")
+    hubRemoteQuery := `insert into bundle.remote_database (foreign_server_name, schema_name, connection_string, username, password)
+        values (
+            'hub', 'hub',
+            'dbname ''aquameta'', host ''hub.aquameta.com'', port ''5432''',
+            'anonymous', 'anonymous'
+        )`
+    _, err := dbpool.Query(context.Background(), hubRemoteQuery)
+    if err != nil {
+        return report, fmt.Errorf("unable to add bundle.remote_database: %v", err)
+    }
+    */
+
+    //
+    // superuser
+    //
+    {
+        item := "superuser " + config.Database.Role
+
+        // on a dry run against a fresh database, endpoint.user doesn't exist yet
+        exists, err := relationExists(dbpool, "endpoint.user")
+        if err == nil && exists {
+            err = dbpool.QueryRow(ctx, "select exists(select 1 from endpoint.user u where (u.role_id).name = $1)",
+                config.Database.Role).Scan(&exists)
+        }
+        if err != nil {
+            return report, fmt.Errorf("unable to check %s: %v", item, err)
+        }
+
+        if exists {
+            step(item, "present", "")
+        } else {
+            if !dryRun {
+                const superuserQuery = "insert into endpoint.user (email, name, active, role_id) values ($1, $2, true, meta.role_id($3))"
+                if _, err := dbpool.Exec(ctx, superuserQuery, config.AquametaUser.Email, config.AquametaUser.Name, config.Database.Role); err != nil {
+                    return report, fmt.Errorf("unable to create %s: %v", item, err)
+                }
+            }
+            step(item, "installed", config.AquametaUser.Email)
+        }
+    }
+
+    //
+    // download and install bundles
+    //
+    /*
+       TODO: switch hub install vs local file install, based on CLI
+
+       // hub install over network
+       log.Print("Downloading Aquameta core bundles from hub.aquameta.com...")
+       bundleQueries := [...]string{
+           "select bundle.remote_mount(id) from bundle.remote_database",
+           "select bundle.remote_pull_bundle(r.id, b.id) from bundle.remote_database r, hub.bundle b",
+           "select bundle.checkout(c.id) from bundle.commit c join bundle.bundle b on b.head_commit_id = c.id;" }
+
+       for i := 0; i < len(bundleQueries); i++ {
+           log.Printf("Setup query: %s", bundleQueries[i])
+           rows, err := dbpool.Query(context.Background(), bundleQueries[i])
+           if err != nil {
+               return report, fmt.Errorf("unable to install Aquameta bundles: %v", err)
+           }
+           rows.Close()
+       }
+    */
+
+    // install from the configured bundle sources
+    repositoryExists, err := relationExists(dbpool, "bundle.repository")
+    if err != nil {
+        return report, fmt.Errorf("unable to check for bundle.repository: %v", err)
+    }
+    sources := config.bundleSources(workingDirectory)
+
+    for _, bundle := range config.bundles() {
+        item := "bundle " + bundle.Name
+
+        // imported is false when the repository row is missing, checkedOut is
+        // false when it was imported but never checked out (e.g. an install
+        // that died between the two)
+        var imported, checkedOut bool
+        if repositoryExists {
+            err := dbpool.QueryRow(ctx, `
+                select
+                    exists(select 1 from bundle.repository r where r.name = $1),
+                    exists(select 1 from bundle.repository r where r.name = $1 and r.checkout_commit_id is not null)`,
+                bundle.Name).Scan(&imported, &checkedOut)
+            if err != nil {
+                return report, fmt.Errorf("unable to check %s: %v", item, err)
+            }
+        }
+
+        if imported && (checkedOut || !bundle.checkout()) {
+            step(item, "present", "")
+            continue
+        }
+
+        content, location, err := readBundle(sources, bundle.Name)
+        if !imported && err != nil {
+            return report, err
+        }
+
+        if !dryRun {
+            if !imported {
+                log.Print("  - "+location)
+                if _, err := dbpool.Exec(ctx, "select bundle.import_repository($1)", string(content)); err != nil {
+                    return report, fmt.Errorf("unable to import %s: %v", item, err)
+                }
+            }
+
+            if bundle.checkout() {
+                if _, err := dbpool.Exec(ctx, "select bundle.checkout($1)", bundle.Name); err != nil {
+                    return report, fmt.Errorf("unable to checkout %s: %v", item, err)
+                }
+            }
+        }
+
+        switch {
+        case imported:
+            step(item, "repaired", "checked out")
+        case bundle.checkout():
+            step(item, "installed", location)
+        default:
+            step(item, "installed", location+", not checked out")
+        }
+    }
+
+    return report, nil
+}
+
+// relationExists reports whether a schema-qualified table or view exists.
+func relationExists(dbpool *pgxpool.Pool, name string) (bool, error) {
+    var exists bool
+    err := dbpool.QueryRow(context.Background(), "select to_regclass($1) is not null", name).Scan(&exists)
+    return exists, err
+}
+
+// copyExtensionFiles copies the control and sql files of Aquameta's extensions
+// into the embedded PostgreSQL server's extension directory.
+func copyExtensionFiles(workingDirectory string, runtimePath string) error {
+    destination := filepath.Join(runtimePath, "share", "postgresql", "extension")
+
+    for _, pattern := range [...]string{"*--*.*.*.sql", "*.control"} {
+        files, err := filepath.Glob(filepath.Join(workingDirectory, "extensions", "*", pattern))
+        if err != nil {
+            return err
+        }
+        for _, file := range files {
+            if err := copyFile(file, filepath.Join(destination, filepath.Base(file))); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func copyFile(source string, destination string) error {
+    in, err := os.Open(source)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    out, err := os.Create(destination)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
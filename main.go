@@ -5,19 +5,81 @@ import (
     "flag"
     "fmt"
     embeddedPostgres "github.com/aquametalabs/embedded-postgres"
+    socketio "github.com/googollee/go-socket.io"
     "github.com/jackc/pgx/v4/pgxpool"
-    "github.com/lib/pq"
+    "io/ioutil"
     "log"
     "net/http"
     "os"
     "os/exec"
     "os/signal"
     "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
     "syscall"
     "time"
 )
 
+const usage = `Usage: aquameta <command> [options]
+
+Commands:
+    serve       start the database (if embedded) and serve HTTP and PGFS.  This
+                is the default command.
+    install     install or repair Aquameta's extensions and core bundles, then exit
+    upgrade     back up the database, then upgrade Aquameta's extensions and
+                core bundles to this version
+    init-db     install and initialize the embedded PostgreSQL server, then exit
+    status      report the state of the database and the Aquameta installation
+    stop        stop a running Aquameta server
+    config      "config check" checks the configuration and lists every problem
+    bootloader  start the bootloader, same as "serve -c conf/bootloader.toml"
+
+Run "aquameta <command> -h" for the options of a command.
+`
+
 func main() {
+    // keep passwords and session ids out of the log
+    log.SetOutput(redactingWriter{os.Stderr})
+
+    // the server's working directory, where conf/, bundles/ and extensions/ live
+    workingDirectory, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    if err != nil {
+        log.Fatalf("Could not determine working directory: %v", err)
+    }
+
+    // `aquameta -c conf/boot.toml` (no command) is the same as `aquameta serve -c conf/boot.toml`
+    command, args := "serve", os.Args[1:]
+    if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+        command, args = args[0], args[1:]
+    }
+
+    switch command {
+    case "serve":
+        serveCommand(workingDirectory, "conf/boot.toml", command, args)
+    case "bootloader":
+        serveCommand(workingDirectory, "conf/bootloader.toml", command, args)
+    case "install":
+        installCommand(workingDirectory, args)
+    case "upgrade":
+        upgradeCommand(workingDirectory, args)
+    case "init-db":
+        initDBCommand(workingDirectory, args)
+    case "status":
+        statusCommand(workingDirectory, args)
+    case "stop":
+        stopCommand(workingDirectory, args)
+    case "config":
+        configCommand(workingDirectory, args)
+    case "help":
+        fmt.Fprint(os.Stderr, usage)
+    default:
+        fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+        os.Exit(2)
+    }
+}
+
+func banner() {
     log.Print(`                                           __          `)
     log.Print(`_____    ________ _______    _____   _____/  |______   `)
     log.Print(`\__  \  / ____/  |  \__  \  /     \_/ __ \   __\__  \  `)
@@ -25,367 +87,414 @@ func main() {
     log.Print(`(____  /\__   |____/(____  /__|_|  /\___  >__| (____  /`)
     log.Print(`     \/    |__|          \/      \/     \/          \/ `)
     log.Print(`                 [ version 0.5.0 ]                     `)
+}
 
-    // log.SetPrefix("[💧 aquameta 💧] ")
-    log.Print("Aquameta server... ENGAGE!")
-    workingDirectory, err := filepath.Abs(filepath.Dir(os.Args[0]))
-    var epg embeddedPostgres.EmbeddedPostgres
+//
+// command line helpers
+//
+
+// newFlagSet returns the flag set for a command, with the -c flag and the
+// config override flags every command shares.  A relative defaultConfig is
+// resolved against the working directory.
+func newFlagSet(command string, workingDirectory string, defaultConfig string) (*flag.FlagSet, *string) {
+    flags := flag.NewFlagSet(command, flag.ExitOnError)
+    flags.Usage = func() {
+        fmt.Fprintf(flags.Output(), "Usage: aquameta %s [options]\n\n", command)
+        flags.PrintDefaults()
+    }
+    configFile := flags.String("c", filepath.Join(workingDirectory, defaultConfig), "configuration file")
+    addConfigFlags(flags)
+    return flags, configFile
+}
 
-    //
-    // trap ctrl-c
-    //
+// loadConfig reads the configuration with readConfig and validates it, or
+// quits listing everything wrong with it.
+func loadConfig(flags *flag.FlagSet, configFile string) tomlConfig {
+    config := readConfig(flags, configFile)
+    if problems := validateConfig(config); len(problems) > 0 {
+        for _, problem := range problems {
+            log.Print("  - " + problem)
+        }
+        log.Fatalf("%s has %d problem(s), see above.  Check it with `aquameta config check`.", configFile, len(problems))
+    }
+    return config
+}
+
+// readConfig loads the configuration with configWithOverrides, or quits with
+// the command's usage.
+func readConfig(flags *flag.FlagSet, configFile string) tomlConfig {
+    config, err := configWithOverrides(flags, configFile)
+    if err != nil {
+        log.Printf("Could not load boot configuration file: %s", err)
+        flags.Usage()
+        log.Fatal("Quitting.")
+    }
+    return config
+}
+
+// configWithOverrides loads the configuration file and applies the flag and
+// environment overrides.  The file may be missing if the overrides are there
+// instead.
+func configWithOverrides(flags *flag.FlagSet, configFile string) (tomlConfig, error) {
+    config, err := getConfig(configFile)
+    if os.IsNotExist(err) && hasConfigOverrides(flags) {
+        log.Printf("No configuration file %s, using the command line and environment.", configFile)
+        config, err = tomlConfig{}, nil
+    }
+    if err != nil {
+        return config, err
+    }
+    if err := applyConfigOverrides(flags, &config); err != nil {
+        return config, fmt.Errorf("invalid configuration override %v", err)
+    }
+    return config, nil
+}
+
+// quit stops the embedded server (if any) before exiting with a fatal error.
+func quit(epg *embeddedPostgres.EmbeddedPostgres, format string, v ...interface{}) {
+    stopDatabase(epg)
+    log.Fatalf(format, v...)
+}
+
+// trapSignals runs cleanup and exits on ctrl-c or SIGTERM.
+func trapSignals(cleanup func()) {
     c := make(chan os.Signal, 1)
     signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
     go func() {
         for sig := range c {
-            if epg.IsStarted() {
-                log.Print("Stopping PostgreSQL")
-                epg.Stop()
-
-            }
+            cleanup()
             log.Fatalf("SIG %s - Good day.", sig)
         }
     }()
+}
 
-    //
-    // load config
-    //
-    var configFile = flag.String("c", "", "configuration file")
-    flag.Parse()
+// shutdownServer takes the server down in order: stop accepting HTTP
+// connections and wait for in-flight requests, detach socket.io sessions,
+// unmount PGFS, close the pools, then stop the embedded server.  The steps that
+// wait share timeout; anything nil was never started.
+func shutdownServer(config tomlConfig, timeout time.Duration, server *http.Server, wsServer *socketio.Server, listener *eventListener, routes *routeTable, dbpools []*pgxpool.Pool, epg *embeddedPostgres.EmbeddedPostgres) {
+    log.Printf("Shutting down, waiting up to %s...", timeout)
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    // Shutdown() closes the listeners right away, then waits for requests to
+    // finish, and socket.io's long polls only finish once their sessions close
+    httpStopped := make(chan error, 1)
+    if server != nil {
+        go func() { httpStopped <- server.Shutdown(ctx) }()
+    } else {
+        httpStopped <- nil
+    }
+    if wsServer != nil {
+        closeWebsockets(ctx, wsServer, listener)
+    }
+    if routes != nil {
+        routes.close(ctx)
+    }
+    if err := <-httpStopped; err != nil {
+        log.Printf("HTTP server did not shut down cleanly: %v", err)
+        server.Close()
+    } else if server != nil {
+        log.Print("HTTP server stopped.")
+    }
+
+    unmountPGFS(config)
+
+    for _, dbpool := range dbpools {
+        if dbpool != nil {
+            dbpool.Close()
+        }
+    }
+    log.Print("Database connections closed.")
+    stopDatabase(epg)
+}
+
+//
+// serve, bootloader
+//
+func serveCommand(workingDirectory string, defaultConfig string, command string, args []string) {
+    flags, configFile := newFlagSet(command, workingDirectory, defaultConfig)
+    pidFile := flags.String("pidfile", filepath.Join(workingDirectory, "aquameta.pid"), "file to write the server's process id to, used by `aquameta stop`")
+    install := flags.Bool("install", command == "bootloader", "install or repair anything missing from the Aquameta installation before serving")
+    debug := flags.Bool("debug", false, "log every statement the server runs, same as -database-debug")
+    flags.Parse(args)
+
+    banner()
 
+    // log.SetPrefix("[💧 aquameta 💧] ")
+    log.Print("Aquameta server... ENGAGE!")
+
+    // without a boot config, fall back to the bootloader so it can write one
+    bootloader := command == "bootloader"
     config, err := getConfig(*configFile)
-    if err != nil {
+    if os.IsNotExist(err) && command == "serve" && !hasConfigOverrides(flags) {
+        bootloaderConfigFile := filepath.Join(workingDirectory, "conf/bootloader.toml")
         log.Printf("Could not load boot configuration file: %s", err)
-        log.Print("Usage:")
-        flag.PrintDefaults()
-        log.Fatal("Quitting.")
-        /*
-           log.Printf("Loading default Bootloader configuration instead from %s", bootloaderConfigFile)
+        log.Printf("Loading default Bootloader configuration instead from %s", bootloaderConfigFile)
 
-           blconfig, err := getConfig(bootloaderConfigFile); if err != nil {
-               log.Fatalf("Could not load bootloader config %s: %s", bootloaderConfigFile, err)
-           }
-           config = blconfig
-        */
+        config, err = configWithOverrides(flags, bootloaderConfigFile)
+        if err != nil {
+            log.Fatalf("Could not load bootloader config %s: %s", bootloaderConfigFile, err)
+        }
+        if problems := validateConfig(config); len(problems) > 0 {
+            log.Fatalf("Invalid bootloader config %s: %s", bootloaderConfigFile, strings.Join(problems, "; "))
+        }
+        bootloader = true
+        *install = true
+    } else {
+        config = loadConfig(flags, *configFile)
+    }
+
+    if *debug {
+        config.Database.Debug = true
+    }
+
+    // the running server's shutdown, for the signal handler
+    var shutdownMu sync.Mutex
+    var shutdown func()
+    setShutdown := func(f func()) {
+        shutdownMu.Lock()
+        shutdown = f
+        shutdownMu.Unlock()
     }
 
     //
-    // setup embedded database
+    // trap ctrl-c
     //
-    if config.Database.Mode == "embedded" {
-        //
-        // initialize epg w/ config settings
-        //
-
-        // TODO: NewDatabase() should be called NewPGServer() or some such... refactor epg
-        epg = *embeddedPostgres.NewDatabase(embeddedPostgres.DefaultConfig().
-            Username(config.Database.Role).
-            Password(config.Database.Password).
-            // Host
-            Port(config.Database.Port).
-            Database(config.Database.DatabaseName).
-            Version(embeddedPostgres.V12).
-            RuntimePath(config.Database.EmbeddedPostgresRuntimePath).
-            StartTimeout(45 * time.Second))
-
-        // has an embedded postgres already been installed?
-        log.Printf("Checking for existing embedded server at %s", config.Database.EmbeddedPostgresRuntimePath)
-        epgFilesExist := true
-        if _, err := os.Stat(config.Database.EmbeddedPostgresRuntimePath); os.IsNotExist(err) {
-            // TODO: we probably want some more robust inspection of the directory.
-            // Check that it has the binary, and a data directory, and generally looks sane.
-            // If it doesn't, QUIT!  (Do NOT install the db here, it might be some other directory
-            // that would get overwritten.
-            log.Printf("Embedded PostgreSQL server found at %s.", config.Database.EmbeddedPostgresRuntimePath)
-            epgFilesExist = false
+    trapSignals(func() {
+        shutdownMu.Lock()
+        f := shutdown
+        shutdownMu.Unlock()
+        if f != nil {
+            f()
         }
+        os.Remove(*pidFile)
+    })
 
-        // if directory doesn't exist, generate an embedded database there
-        if !epgFilesExist {
-            log.Printf("Embedded PostgreSQL server not found at %s.  Installing...", config.Database.EmbeddedPostgresRuntimePath)
+    if err := ioutil.WriteFile(*pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+        log.Printf("Could not write pid file %s: %v", *pidFile, err)
+    }
+    defer os.Remove(*pidFile)
+
+    // the bootloader writes the boot config serve would have read, and
+    // restarts into it, with the same overrides, installing Aquameta into the
+    // new database
+    bootConfigFile := *configFile
+    if command == "bootloader" {
+        bootConfigFile = filepath.Join(workingDirectory, "conf", "boot.toml")
+    }
+    overrides := func(config *tomlConfig) error {
+        return applyConfigOverrides(flags, config)
+    }
+    for serve(workingDirectory, config, bootConfigFile, overrides, *install, bootloader, setShutdown) {
+        log.Printf("Restarting with the new boot configuration %s...", bootConfigFile)
+        config, bootloader, *install = loadConfig(flags, bootConfigFile), false, true
+        config.Database.Debug = config.Database.Debug || *debug
+    }
+    log.Print("Good day.")
+}
 
-            if err := epg.Install(); err != nil {
-                log.Fatalf("Unable to install PostgreSQL: %v", err)
-            }
-            log.Printf("PostgreSQL server installed at %s", config.Database.EmbeddedPostgresRuntimePath)
-        }
+// serve starts the database and the servers with config, and runs until one of
+// them stops or the bootloader halts.  It returns true if the bootloader wrote
+// a new boot config to bootConfigFile, with overrides applied to check it, to
+// be restarted with.  setShutdown is handed serve's shutdown, so a signal can
+// take it down too.
+func serve(workingDirectory string, config tomlConfig, bootConfigFile string, overrides func(*tomlConfig) error, install bool, bootloader bool, setShutdown func(func())) bool {
+    var epg *embeddedPostgres.EmbeddedPostgres
+    var dbpool, eventsPool, pgfsPool *pgxpool.Pool
+    var server *http.Server
+    var wsServer *socketio.Server
+    var listener *eventListener
+    var routes *routeTable
+
+    // shutdown runs once, whether from a signal, /bootloader/halt or a
+    // server stopping on its own; later calls wait for the first to finish
+    var shutdownOnce sync.Once
+    health := newServerHealth()
+    shutdown := func() {
+        shutdownOnce.Do(func() {
+            health.setState("stopping")
+            shutdownServer(config, config.HTTPServer.shutdownTimeout(), server, wsServer, listener, routes, []*pgxpool.Pool{dbpool, eventsPool, pgfsPool}, epg)
+        })
+    }
+    setShutdown(shutdown)
 
-        //
-        // start the epg database daemon
-        //
-        log.Printf("Starting PostgreSQL server from %s...", config.Database.EmbeddedPostgresRuntimePath)
-        if err := epg.Start(); err != nil {
-            log.Fatalf("Unable to start PostgreSQL: %v", err)
-        }
-        log.Print("PostgreSQL server started.")
+    // the servers stopping on their own, or the bootloader asking to halt or
+    // restart with a new config
+    httpDone := make(chan bool, 1)
+    fuseDone := make(chan bool, 1)
+    halt := make(chan bool, 1)
+    restart := make(chan bool, 1)
 
-        defer func() {
-            log.Print("Stopping PostgreSQL Server...")
-            if err := epg.Stop(); err != nil {
-                log.Fatalf("Database halt failed: %v", err)
-            } else {
-                log.Print("Database stopped")
-            }
-        }()
-
-        //
-        // CREATE DATABASE
-        //
-        if !epgFilesExist {
-            if err := epg.CreateDatabase(); err != nil {
-                // TODO: create epg.DatabaseExists() method
-                // log.Fatalf("Unable to create database: %v", err)
+    //
+    // start http server, with only the health checks until install is done
+    //
+    mux := http.NewServeMux()
+    mux.HandleFunc("/_health/live", healthLive)
+    mux.HandleFunc("/_health/ready", health.ready)
+    server = &http.Server{
+        Addr: config.HTTPServer.IP+":"+config.HTTPServer.Port,
+        Handler: recoverPanics(mux),
+    }
+    log.Printf("Starting HTTP server\n\n%s://%s:%s%s\n\n",
+        config.HTTPServer.Protocol,
+        config.HTTPServer.IP,
+        config.HTTPServer.Port,
+        config.HTTPServer.StartupURL)
+
+    go func() {
+        var err error
+        if config.HTTPServer.Protocol == "http" {
+            err = server.ListenAndServe()
+        } else {
+            if config.HTTPServer.Protocol == "https" {
+                // https://github.com/denji/golang-tls
+                err = server.ListenAndServeTLS(
+                    config.HTTPServer.SSLCertificateFile,
+                    config.HTTPServer.SSLKeyFile)
             } else {
-                log.Print("PostgreSQL server installed to %s", config.Database.EmbeddedPostgresRuntimePath)
+                err = fmt.Errorf("Unrecognized protocol: %s", config.HTTPServer.Protocol)
             }
         }
-    }
+        // ErrServerClosed is shutdown() at work
+        if err != http.ErrServerClosed {
+            log.Print(err)
+            httpDone <- true
+        }
+    }()
 
     //
-    // connect to database
+    // setup embedded database
     //
-    connectionString := fmt.Sprintf("postgresql://%s:%s@%s:%d/%s", config.Database.Role, config.Database.Password, config.Database.Host, config.Database.Port, config.Database.DatabaseName)
-    log.Printf("Database: %s", connectionString)
-
-    dbpool, err := pgxpool.Connect(context.Background(), connectionString)
+    epg, err := startDatabase(config)
     if err != nil {
-        log.Fatalf("Unable to connect to database: %v", err)
+        log.Fatal(err)
     }
-    log.Print("Connected to database.")
-    defer dbpool.Close()
 
     //
-    // pg_settings
+    // connect to database
     //
-    // CLI switch here:  if --debug, else ...
-    settingsQueries := [...]string{
-        fmt.Sprintf("set log_min_messages='notice'"), // { notice, warning, error, ...}
-        fmt.Sprintf("set log_statement='all'"),
-        fmt.Sprintf("set statement_timeout=0"),
-    }
-    for i := 0; i < len(settingsQueries); i++ {
-        _, err := dbpool.Exec(context.Background(), settingsQueries[i])
-        if err != nil {
-            epg.Stop()
-            log.Fatalf("Unable to update settings: %v", err)
-        }
+    dbpool, err = connectDatabase(config)
+    if err != nil {
+        quit(epg, "%v", err)
     }
-    log.Print("PostgreSQL settings have been set.")
 
     //
     // - install aquameta extensions
     //
-    var ct int
-    dbQuery := fmt.Sprintf("select count(*) as ct from pg_catalog.pg_extension where extname in ('meta','meta_triggers','pg_bundle','event','endpoint','ide','documentation','widget','semantics')")
-    err = dbpool.QueryRow(context.Background(), dbQuery).Scan(&ct)
+    health.setState("installing")
     log.Print("Checking for Aquameta installation....")
+    installed, report, err := aquametaInstalled(config, dbpool, workingDirectory)
+    if err != nil {
+        quit(epg, "Unable to check for Aquameta installation: %v", err)
+    }
 
-    // TODO: handle this with a flag instead. Stop installing by default.
-    if ct != 9 {
-
-        //
-        // install aquameta extensions
-        //
-        log.Print("Aquameta is not installed on this database.  Installing...")
-
-        if config.Database.Mode == "embedded" {
-            exec.Command("/bin/sh", "-c", "cp "+workingDirectory+"/extensions/*/*--*.*.*.sql "+config.Database.EmbeddedPostgresRuntimePath+"/share/postgresql/extension/").Run()
-            exec.Command("/bin/sh", "-c", "cp "+workingDirectory+"/extensions/*/*.control "+config.Database.EmbeddedPostgresRuntimePath+"/share/postgresql/extension/").Run()
-            log.Print("Extensions copied to PostgreSQL's extensions directory.")
+    if !installed {
+        if !install {
+            report.Log()
+            quit(epg, "Aquameta is not fully installed on this database.  Run `aquameta install`, or serve with -install.")
         }
 
-        installQueries := [...]string{
-            "create extension if not exists hstore schema public",
-            "create extension if not exists \"uuid-ossp\" schema public",
-            // "create extension if not exists pg_uuidv7 schema public",
-            "create extension if not exists pgcrypto schema public",
-            "create extension if not exists postgres_fdw schema public",
-            "create extension meta version '0.5.0'",
-            "create extension meta_triggers version '0.5.0'",
-            "create extension pg_bundle version '0.5.0'",
-            "create extension event version '0.5.0'",
-            "create extension endpoint version '0.5.0'",
-            "create extension widget version '0.5.0'",
-            "create extension semantics version '0.5.0'",
-            "create extension ide version '0.5.0'",
-            "create extension documentation version '0.5.0'"}
-
-        for i := 0; i < len(installQueries); i++ {
-            log.Print(installQueries[i])
-            _, err := dbpool.Exec(context.Background(), installQueries[i])
-            if err != nil {
-                log.Fatalf("Unable to install extensions: %v", err)
-                if config.Database.Mode == "embedded" {
-                    epg.Stop()
-                }
-            }
-        }
-        log.Print("Extensions were successfully installed.")
-
-        //
-        // setup hub remote
-        //
-        /*
-        log.Print("Adding bundle.remote_database for hub...")
-        hubRemoteQuery := `insert into bundle.remote_database (foreign_server_name, schema_name, connection_string, username, password)
-            values (
-                'hub', 'hub',
-                'dbname ''aquameta'', host ''hub.aquameta.com'', port ''5432''',
-                'anonymous', 'anonymous'
-            )`
-        _, err := dbpool.Query(context.Background(), hubRemoteQuery)
-        if err != nil {
-            if config.Database.Mode == "embedded" {
-                epg.Stop()
-            }
-            log.Fatalf("Unable to add bundle.remote_database: %v", err)
-        }
-        */
-
-        //
-        // create superuser
-        //
-        log.Print("Setting up permissions...")
-
-        superuserQuery := fmt.Sprintf("insert into endpoint.user (email, name, active, role_id) values (%s, %s, true, meta.role_id(%s))",
-            pq.QuoteLiteral(config.AquametaUser.Email),
-            pq.QuoteLiteral(config.AquametaUser.Name),
-            pq.QuoteLiteral(config.Database.Role))
-        rows, err := dbpool.Query(context.Background(), superuserQuery)
+        log.Print("Aquameta is not fully installed on this database.  Installing...")
+        report, err := installAquameta(config, dbpool, workingDirectory, false)
+        report.Log()
         if err != nil {
-            log.Fatalf("Unable to create superuser: %v", err)
+            quit(epg, "Installation failed: %v", err)
         }
-        rows.Close()
-
-        //
-        // download and install bundles
-        //
-        /*
-           TODO: switch hub install vs local file install, based on CLI
-
-           // hub install over network
-           log.Print("Downloading Aquameta core bundles from hub.aquameta.com...")
-           bundleQueries := [...]string{
-               "select bundle.remote_mount(id) from bundle.remote_database",
-               "select bundle.remote_pull_bundle(r.id, b.id) from bundle.remote_database r, hub.bundle b",
-               "select bundle.checkout(c.id) from bundle.commit c join bundle.bundle b on b.head_commit_id = c.id;" }
-
-           for i := 0; i < len(bundleQueries); i++ {
-               log.Printf("Setup query: %s", bundleQueries[i])
-               rows, err := dbpool.Query(context.Background(), bundleQueries[i])
-               if err != nil {
-                   log.Fatalf("Unable to install Aquameta bundles: %v", err)
-               }
-               rows.Close()
-           }
-        */
-
-        // install from local filesystem
-        log.Print("Installing core bundles from source")
-        coreBundles := [...]string{
-            "org.aquameta.core.mimetypes",
-            "org.aquameta.core.endpoint",
-            "org.aquameta.core.widget",
-            "org.aquameta.core.ide",
-            "org.aquameta.core.semantics",
-            "org.aquameta.games.snake",
-            "org.aquameta.ui.fsm",
-            "org.aquameta.ui.layout",
-            "org.aquameta.ui.tags",
-            "org.aquameta.core.bootloader",
-            // "org.aquameta.core.repository",
-        }
-
-        for i := 0; i < len(coreBundles); i++ {
-            log.Print("  - "+coreBundles[i])
-            q := "select bundle.import_repository(pg_read_file('" + workingDirectory + "/bundles/" + coreBundles[i] + ".json'))"
-            _, err := dbpool.Exec(context.Background(), q)
-            if err != nil {
-                if config.Database.Mode == "embedded" {
-                    epg.Stop()
-                }
-                log.Fatalf("Unable to install Aquameta bundles: %v", err)
-            }
-
-            _, err = dbpool.Exec(context.Background(), "select bundle.checkout('" + coreBundles[i] + "')")
-            if err != nil {
-                log.Fatalf("Unable to checkout core bundles: %v", err)
-            }
-        }
-
         log.Print("Installation complete!")
+    }
 
+    outdated, err := outdatedExtensions(dbpool)
+    if err != nil {
+        quit(epg, "Unable to check extension versions: %v", err)
+    }
+    for _, ext := range outdated {
+        log.Printf("Extension %s is at version %s, this server expects %s.  Run `aquameta upgrade`.", ext.Name, ext.InstalledVersion, ext.Version)
+    }
+
+    // done installing, the handlers get a pool with statement timeouts
+    dbpool.Close()
+    dbpool, err = connectHTTPPool(config)
+    if err != nil {
+        shutdown()
+        log.Fatal(err)
     }
 
     bootloaderHandler := func(w http.ResponseWriter, req *http.Request) {
 
         log.Println(req.Proto, req.Method, req.RequestURI)
 
-        // halt
+        // halt, after this response goes out
         if req.RequestURI == "/bootloader/halt" {
             log.Print("Bootloader has requested that I halt, so I will halt.")
-            if epg.IsStarted() {
-                log.Print("Stopping PostgreSQL")
-                epg.Stop()
+            select {
+            case halt <- true:
+            default:
             }
-
-            log.Fatal("Good day.")
+            return
         }
 
-        // write config
-        if req.RequestURI == "/bootloader/configure" {
-            log.Println("Ok I will write out the specified .conf file to disk")
+        // write config, then restart with it after this response goes out
+        if req.URL.Path == "/bootloader/configure" {
+            if !bootloader {
+                http.NotFound(w, req)
+                return
+            }
+            if configure(w, req, config, bootConfigFile, overrides) {
+                select {
+                case restart <- true:
+                default:
+                }
+            }
+            return
         }
+
+        http.NotFound(w, req)
     }
 
     //
     // attach handlers
     //
     // TODO: configure these in the database??
-    http.HandleFunc("/_socket/detach/", websocketDetach)
-    http.Handle("/socket.io/", websocket(dbpool))
-    http.HandleFunc("/bootloader/", bootloaderHandler)
-    http.HandleFunc("/endpoint/", endpoint(dbpool))
-    http.HandleFunc("/", resource(dbpool))
-
-    httpDone := make(chan bool)
-    fuseDone := make(chan bool)
-
-    //
-    // start http server
-    //
-    log.Printf("Starting HTTP server\n\n%s://%s:%s%s\n\n",
-        config.HTTPServer.Protocol,
-        config.HTTPServer.IP,
-        config.HTTPServer.Port,
-        config.HTTPServer.StartupURL)
-
-    go func() {
-        if config.HTTPServer.Protocol == "http" {
-            http.ListenAndServe(config.HTTPServer.IP+":"+config.HTTPServer.Port, nil)
-        } else {
-            if config.HTTPServer.Protocol == "https" {
-                // https://github.com/denji/golang-tls
-                log.Fatal(http.ListenAndServeTLS(
-                    config.HTTPServer.IP+":"+config.HTTPServer.Port,
-                    config.HTTPServer.SSLCertificateFile,
-                    config.HTTPServer.SSLKeyFile,
-                    nil))
-            } else {
-                log.Fatal("Unrecognized protocol: " + config.HTTPServer.Protocol)
-            }
+    // the server is already listening, ServeMux takes handlers while it serves
+    eventsPool, err = connectEventsPool(config)
+    if err != nil {
+        shutdown()
+        log.Fatal(err)
+    }
+    wsServer, listener = websocket(eventsPool)
+    routes = watchRoutes(eventsPool)
+    mux.HandleFunc("/_socket/detach/", websocketDetach(listener))
+    mux.Handle("/socket.io/", wsServer)
+    if config.PGFS.Enabled {
+        pgfsPool, err = connectPGFSPool(config)
+        if err != nil {
+            shutdown()
+            log.Fatal(err)
         }
-
-        httpDone <- true
-
-    }()
-
+        // not ready until pgfs() has mounted it
+        setPGFSState("mounting")
+    } else {
+        setPGFSState("disabled")
+    }
+    mux.HandleFunc("/bootloader/", bootloaderHandler)
+    compression := newCompressor(config.HTTPServer.Compression)
+    mux.HandleFunc("/endpoint/", compression.handler(endpoint(dbpool)))
+    resourceHandler := compression.handler(resource(dbpool, routes, compression))
+    mux.HandleFunc("/login", login(dbpool, resourceHandler))
+    mux.HandleFunc("/logout", logout(dbpool))
+    mux.HandleFunc("/", resourceHandler)
+    health.serving(map[string]*pgxpool.Pool{
+        "http": dbpool,
+        "events": eventsPool,
+        "pgfs": pgfsPool,
+    }, routes, listener)
 
     //
     // start pgfs (if OS is supported and it's enabled in config)
     //
 
-    go pgfs(config, dbpool, fuseDone)
+    go pgfs(config, pgfsPool, fuseDone)
 
 
     //
@@ -406,18 +515,306 @@ func main() {
        w.Run()
     */
 
-    select {
-    case <-httpDone:
-        println("HTTP server stopped.")
-    case <-fuseDone:
-        println("FUSE filesystem stopped.")
+    var next bool
+    for stopped := false; !stopped; {
+        select {
+        case <-httpDone:
+            log.Print("HTTP server stopped.")
+            stopped = true
+        case mounted := <-fuseDone:
+            // a PGFS that never mounted leaves the server running without it
+            if mounted {
+                log.Print("FUSE filesystem stopped.")
+                stopped = true
+            }
+        case <-halt:
+            stopped = true
+        case next = <-restart:
+            stopped = true
+        }
+    }
+
+    shutdown()
+    return next
+}
+
+//
+// install
+//
+func installCommand(workingDirectory string, args []string) {
+    flags, configFile := newFlagSet("install", workingDirectory, "conf/boot.toml")
+    dryRun := flags.Bool("dry-run", false, "report what would be installed or repaired, without changing anything")
+    flags.Parse(args)
+
+    config := loadConfig(flags, *configFile)
+
+    // a dry run must not install an embedded server either
+    if *dryRun && config.Database.Mode == "embedded" {
+        installed, err := inspectRuntime(config)
+        if err != nil {
+            log.Fatalf("Unusable embedded server: %v", err)
+        }
+        if !installed {
+            log.Printf("Embedded PostgreSQL server not found at %s; everything would be installed.", config.Database.EmbeddedPostgresRuntimePath)
+            return
+        }
+    }
+
+    var epg *embeddedPostgres.EmbeddedPostgres
+    trapSignals(func() { stopDatabase(epg) })
+
+    epg, err := startDatabase(config)
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer stopDatabase(epg)
+
+    dbpool, err := connectDatabase(config)
+    if err != nil {
+        quit(epg, "%v", err)
+    }
+    defer dbpool.Close()
+
+    if *dryRun {
+        log.Print("Checking Aquameta installation (dry run)...")
+    } else {
+        log.Print("Installing Aquameta...")
+    }
+    report, err := installAquameta(config, dbpool, workingDirectory, *dryRun)
+    report.Log()
+    if err != nil {
+        dbpool.Close()
+        quit(epg, "Installation failed: %v", err)
+    }
+
+    switch {
+    case report.Complete():
+        log.Print("Aquameta is already installed on this database.")
+    case *dryRun:
+        log.Print("Dry run, nothing was changed.")
+    default:
+        log.Print("Installation complete!")
     }
+}
+
+//
+// upgrade
+//
+func upgradeCommand(workingDirectory string, args []string) {
+    flags, configFile := newFlagSet("upgrade", workingDirectory, "conf/boot.toml")
+    dryRun := flags.Bool("dry-run", false, "report what would be upgraded, without changing anything")
+    backupDirectory := flags.String("backup-dir", filepath.Join(workingDirectory, "backups"), "directory to write the pre-upgrade pg_dump to")
+    noBackup := flags.Bool("no-backup", false, "skip the pre-upgrade backup")
+    flags.Parse(args)
+
+    config := loadConfig(flags, *configFile)
+
+    var epg *embeddedPostgres.EmbeddedPostgres
+    trapSignals(func() { stopDatabase(epg) })
+
+    epg, err := startDatabase(config)
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer stopDatabase(epg)
+
+    dbpool, err := connectDatabase(config)
+    if err != nil {
+        quit(epg, "%v", err)
+    }
+    defer dbpool.Close()
+
+    if !*dryRun && !*noBackup {
+        log.Printf("Backing up database %s...", config.Database.DatabaseName)
+        file, err := backupDatabase(config, *backupDirectory)
+        if err != nil {
+            dbpool.Close()
+            quit(epg, "Backup failed, not upgrading: %v", err)
+        }
+        log.Printf("Database backed up to %s", file)
+    }
+
+    if *dryRun {
+        log.Print("Checking for upgrades (dry run)...")
+    } else {
+        log.Print("Upgrading Aquameta...")
+    }
+    report, err := upgradeAquameta(config, dbpool, workingDirectory, *dryRun)
+    report.Log()
+    if err != nil {
+        dbpool.Close()
+        quit(epg, "Upgrade failed: %v", err)
+    }
+
+    switch {
+    case report.Complete():
+        log.Print("Aquameta is up to date.")
+    case *dryRun:
+        log.Print("Dry run, nothing was changed.")
+    default:
+        log.Print("Upgrade complete!")
+    }
+}
+
+//
+// init-db
+//
+func initDBCommand(workingDirectory string, args []string) {
+    flags, configFile := newFlagSet("init-db", workingDirectory, "conf/boot.toml")
+    flags.Parse(args)
+
+    config := loadConfig(flags, *configFile)
+    if config.Database.Mode != "embedded" {
+        log.Fatalf("init-db only applies to embedded mode; %s uses a %s database.", *configFile, config.Database.Mode)
+    }
+
+    var epg *embeddedPostgres.EmbeddedPostgres
+    trapSignals(func() { stopDatabase(epg) })
+
+    epg, err := startDatabase(config)
+    if err != nil {
+        log.Fatal(err)
+    }
+    stopDatabase(epg)
+    log.Printf("Embedded PostgreSQL server initialized at %s", config.Database.EmbeddedPostgresRuntimePath)
+}
+
+//
+// status
+//
+func statusCommand(workingDirectory string, args []string) {
+    flags, configFile := newFlagSet("status", workingDirectory, "conf/boot.toml")
+    flags.Parse(args)
+
+    config, err := configWithOverrides(flags, *configFile)
+    if err != nil {
+        fmt.Printf("config:     %s (unreadable: %v)\n", *configFile, err)
+        os.Exit(1)
+    }
+    fmt.Printf("config:     %s\n", *configFile)
+    fmt.Printf("mode:       %s\n", config.Database.Mode)
 
     if config.Database.Mode == "embedded" {
-        if epg.IsStarted() {
-            epg.Stop()
+        installed, err := inspectRuntime(config)
+        switch {
+        case err != nil:
+            fmt.Printf("embedded:   unusable (%v)\n", err)
+            os.Exit(1)
+        case installed:
+            fmt.Printf("embedded:   installed at %s\n", config.Database.EmbeddedPostgresRuntimePath)
+        default:
+            fmt.Printf("embedded:   not installed at %s\n", config.Database.EmbeddedPostgresRuntimePath)
         }
     }
 
-    log.Fatal("Good day.")
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    dbpool, err := pgxpool.Connect(ctx, connectionString(config))
+    if err != nil {
+        fmt.Printf("database:   unreachable (%v)\n", err)
+        os.Exit(1)
+    }
+    defer dbpool.Close()
+    if dir := config.Database.socketDirectory(); dir != "" {
+        fmt.Printf("database:   %s on socket %s, port %d\n", config.Database.DatabaseName, dir, config.Database.Port)
+    } else {
+        fmt.Printf("database:   %s on %s:%d\n", config.Database.DatabaseName, config.Database.Host, config.Database.Port)
+    }
+
+    installed, report, err := aquametaInstalled(config, dbpool, workingDirectory)
+    switch {
+    case err != nil:
+        fmt.Printf("aquameta:   unknown (%v)\n", err)
+    case installed:
+        fmt.Printf("aquameta:   installed\n")
+    default:
+        fmt.Printf("aquameta:   incomplete\n")
+        for _, step := range report {
+            if step.Action != "present" {
+                fmt.Printf("            missing %s\n", step.Item)
+            }
+        }
+    }
+}
+
+//
+// stop
+//
+func stopCommand(workingDirectory string, args []string) {
+    flags, configFile := newFlagSet("stop", workingDirectory, "conf/boot.toml")
+    pidFile := flags.String("pidfile", filepath.Join(workingDirectory, "aquameta.pid"), "pid file written by `aquameta serve`")
+    timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for the server to exit")
+    flags.Parse(args)
+
+    b, err := ioutil.ReadFile(*pidFile)
+    if err == nil {
+        pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+        if err != nil {
+            log.Fatalf("Invalid pid file %s: %v", *pidFile, err)
+        }
+
+        process, err := os.FindProcess(pid)
+        if err == nil && process.Signal(syscall.Signal(0)) == nil {
+            log.Printf("Stopping Aquameta server (pid %d)...", pid)
+            if err := process.Signal(syscall.SIGTERM); err != nil {
+                log.Fatalf("Unable to signal process %d: %v", pid, err)
+            }
+
+            deadline := time.Now().Add(*timeout)
+            for process.Signal(syscall.Signal(0)) == nil {
+                if time.Now().After(deadline) {
+                    log.Fatalf("Server (pid %d) did not stop within %s.", pid, *timeout)
+                }
+                time.Sleep(250 * time.Millisecond)
+            }
+            log.Print("Aquameta server stopped.")
+            return
+        }
+        log.Printf("Aquameta server (pid %d) is not running.", pid)
+        os.Remove(*pidFile)
+    }
+
+    // no server to signal, but an embedded PostgreSQL may have been left running
+    config, err := configWithOverrides(flags, *configFile)
+    if err != nil || config.Database.Mode != "embedded" {
+        log.Print("Nothing to stop.")
+        return
+    }
+    pgCtl := filepath.Join(config.Database.EmbeddedPostgresRuntimePath, "bin", "pg_ctl")
+    dataDirectory := filepath.Join(config.Database.EmbeddedPostgresRuntimePath, "data")
+    if _, err := os.Stat(filepath.Join(dataDirectory, "postmaster.pid")); err != nil {
+        log.Print("Nothing to stop.")
+        return
+    }
+    log.Printf("Stopping embedded PostgreSQL server at %s...", config.Database.EmbeddedPostgresRuntimePath)
+    if out, err := exec.Command(pgCtl, "stop", "-w", "-D", dataDirectory).CombinedOutput(); err != nil {
+        log.Fatalf("pg_ctl stop failed: %v\n%s", err, out)
+    }
+    log.Print("PostgreSQL server stopped.")
+}
+
+//
+// config
+//
+func configCommand(workingDirectory string, args []string) {
+    if len(args) == 0 || args[0] != "check" {
+        fmt.Fprint(os.Stderr, "Usage: aquameta config check [options]\n\nRun \"aquameta config check -h\" for its options.\n")
+        os.Exit(2)
+    }
+
+    flags, configFile := newFlagSet("config check", workingDirectory, "conf/boot.toml")
+    flags.Parse(args[1:])
+
+    config := readConfig(flags, *configFile)
+    problems := validateConfig(config)
+    if len(problems) == 0 {
+        fmt.Printf("%s: ok\n", *configFile)
+        return
+    }
+
+    fmt.Printf("%s: %d problem(s)\n", *configFile, len(problems))
+    for _, problem := range problems {
+        fmt.Printf("  - %s\n", problem)
+    }
+    os.Exit(1)
 }
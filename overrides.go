@@ -0,0 +1,299 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "github.com/BurntSushi/toml"
+    "io/ioutil"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// Every field of the Database, AquametaUser, HTTPServer and PGFS sections,
+// and of the tables inside them like Database.Pool, can be overridden from the
+// command line or the environment, e.g. Database.Pool.MaxConns by
+// -database-pool-max-conns or AQUAMETA_DATABASE_POOL_MAX_CONNS.  Secrets also
+// have a File variant, -database-password-file or
+// AQUAMETA_DATABASE_PASSWORD_FILE, whose value is the path of a file holding
+// the value, for secrets mounted from disk.  From highest precedence to lowest:
+//
+//     1. -database-password
+//     2. -database-password-file
+//     3. AQUAMETA_DATABASE_PASSWORD
+//     4. AQUAMETA_DATABASE_PASSWORD_FILE
+//     5. PasswordFile in the config file (Database.Password only)
+//     6. Password in the config file
+//
+// Lists like HTTPServer.Compression.Encodings are comma separated, "gzip,br".
+// Settings tables like Database.Settings take TOML key/value pairs,
+// `lock_timeout = "5s", work_mem = "64MB"`, which are set on top of the
+// config file's.
+var overrideSections = [...]string{"Database", "AquametaUser", "HTTPServer", "PGFS"}
+
+// the fields that have a File variant
+var secretFields = map[string]bool{
+    "Database.Role": true,
+    "Database.Password": true,
+}
+
+// configField is one overridable field of tomlConfig.
+type configField struct {
+    Path []string       // e.g. Database, Pool, MaxConns
+    Kind reflect.Kind
+}
+
+// configFields lists the overridable fields, skipping the config file's own
+// File variants like Database.PasswordFile.
+func configFields() []configField {
+    var fields []configField
+    configType := reflect.TypeOf(tomlConfig{})
+    for _, section := range overrideSections {
+        sectionField, _ := configType.FieldByName(section)
+        fields = appendConfigFields(fields, []string{section}, sectionField.Type)
+    }
+    return fields
+}
+
+// appendConfigFields appends the overridable fields of the table at path, and
+// of the tables inside it.
+func appendConfigFields(fields []configField, path []string, table reflect.Type) []configField {
+    for i := 0; i < table.NumField(); i++ {
+        f := table.Field(i)
+        if base := strings.TrimSuffix(f.Name, "File"); base != f.Name {
+            if _, ok := table.FieldByName(base); ok {
+                continue
+            }
+        }
+        fieldPath := append(append([]string(nil), path...), f.Name)
+        switch f.Type.Kind() {
+        case reflect.Struct:
+            fields = appendConfigFields(fields, fieldPath, f.Type)
+        case reflect.String, reflect.Bool, reflect.Int, reflect.Int32, reflect.Uint32:
+            fields = append(fields, configField{fieldPath, f.Type.Kind()})
+        case reflect.Slice:
+            if f.Type.Elem().Kind() == reflect.String {
+                fields = append(fields, configField{fieldPath, reflect.Slice})
+            }
+        case reflect.Map:
+            if f.Type.Key().Kind() == reflect.String && f.Type.Elem().Kind() == reflect.Interface {
+                fields = append(fields, configField{fieldPath, reflect.Map})
+            }
+        }
+    }
+    return fields
+}
+
+// name returns the field's name in the config, e.g. Database.Pool.MaxConns.
+func (f configField) name() string {
+    return strings.Join(f.Path, ".")
+}
+
+// hasFileVariant reports whether the field can be read from a file.
+func (f configField) hasFileVariant() bool {
+    return secretFields[f.name()]
+}
+
+// words splits the field's path into lowercase words, e.g.
+// HTTPServer.SSLKeyFile into http server ssl key file.
+func (f configField) words() []string {
+    var words []string
+    for _, name := range f.Path {
+        words = append(words, splitCamelCase(name)...)
+    }
+    return words
+}
+
+func (f configField) flagName() string {
+    return strings.Join(f.words(), "-")
+}
+
+func (f configField) envName() string {
+    return "AQUAMETA_" + strings.ToUpper(strings.Join(f.words(), "_"))
+}
+
+func splitCamelCase(s string) []string {
+    var words []string
+    runes := []rune(s)
+    start := 0
+    for i := 1; i < len(runes); i++ {
+        // a new word starts at an upper case letter after a lower case one, or
+        // at the last upper case letter of an acronym, e.g. SSL|Key
+        if unicode.IsUpper(runes[i]) &&
+            (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+            words = append(words, strings.ToLower(string(runes[start:i])))
+            start = i
+        }
+    }
+    return append(words, strings.ToLower(string(runes[start:])))
+}
+
+// overrideFlag is a config override flag.  Its value is parsed when it's
+// applied, so bool flags only need to act like one on the command line.
+type overrideFlag struct {
+    value string
+    isBool bool
+}
+
+func (f *overrideFlag) String() string {
+    return f.value
+}
+
+func (f *overrideFlag) Set(value string) error {
+    f.value = value
+    return nil
+}
+
+func (f *overrideFlag) IsBoolFlag() bool {
+    return f.isBool
+}
+
+// addConfigFlags adds an override flag for each config field to flags.
+func addConfigFlags(flags *flag.FlagSet) {
+    for _, field := range configFields() {
+        flags.Var(&overrideFlag{isBool: field.Kind == reflect.Bool}, field.flagName(), "override "+field.name())
+        if field.hasFileVariant() {
+            flags.Var(&overrideFlag{}, field.flagName()+"-file", "read "+field.name()+" from this file")
+        }
+    }
+}
+
+// configOverride finds the highest precedence override of a field, if any,
+// and where it came from.
+func configOverride(flags *flag.FlagSet, field configField) (value string, source string, ok bool, err error) {
+    set := make(map[string]string)
+    flags.Visit(func(f *flag.Flag) {
+        set[f.Name] = f.Value.String()
+    })
+
+    if value, ok := set[field.flagName()]; ok {
+        return value, "-" + field.flagName(), true, nil
+    }
+    if field.hasFileVariant() {
+        if file, ok := set[field.flagName()+"-file"]; ok {
+            value, err := readSecret(file)
+            return value, "-" + field.flagName() + "-file", true, err
+        }
+    }
+    if value, ok := os.LookupEnv(field.envName()); ok {
+        return value, field.envName(), true, nil
+    }
+    if field.hasFileVariant() {
+        if file, ok := os.LookupEnv(field.envName() + "_FILE"); ok {
+            value, err := readSecret(file)
+            return value, field.envName() + "_FILE", true, err
+        }
+    }
+    return "", "", false, nil
+}
+
+// hasConfigOverrides reports whether any config field is overridden, in which
+// case a missing config file isn't an error.
+func hasConfigOverrides(flags *flag.FlagSet) bool {
+    for _, field := range configFields() {
+        if _, _, ok, _ := configOverride(flags, field); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// applyConfigOverrides sets config's fields from their File variants in the
+// config file, then from flags and the environment.
+func applyConfigOverrides(flags *flag.FlagSet, config *tomlConfig) error {
+    configValue := reflect.ValueOf(config).Elem()
+
+    for _, field := range configFields() {
+        table := configValue
+        for _, name := range field.Path[:len(field.Path)-1] {
+            table = table.FieldByName(name)
+        }
+        fieldName := field.Path[len(field.Path)-1]
+        target := table.FieldByName(fieldName)
+
+        value, source, ok, err := configOverride(flags, field)
+        if err != nil {
+            return fmt.Errorf("%s: %v", source, err)
+        }
+
+        // the config file's own File variant, e.g. Database.PasswordFile
+        if !ok {
+            if file := table.FieldByName(fieldName + "File"); file.IsValid() && file.String() != "" {
+                source = field.name() + "File"
+                value, err = readSecret(file.String())
+                if err != nil {
+                    return fmt.Errorf("%s: %v", source, err)
+                }
+                ok = true
+            }
+        }
+        if !ok {
+            continue
+        }
+
+        if err := setConfigField(target, field, value); err != nil {
+            return fmt.Errorf("%s: %v", source, err)
+        }
+    }
+    return nil
+}
+
+// setConfigField parses value into target, the field's value in the config.
+func setConfigField(target reflect.Value, field configField, value string) error {
+    switch field.Kind {
+    case reflect.String:
+        target.SetString(value)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(value)
+        if err != nil {
+            return fmt.Errorf("%q is not true or false", value)
+        }
+        target.SetBool(b)
+    case reflect.Int, reflect.Int32:
+        n, err := strconv.ParseInt(value, 10, target.Type().Bits())
+        if err != nil {
+            return fmt.Errorf("%q is not a number", value)
+        }
+        target.SetInt(n)
+    case reflect.Uint32:
+        n, err := strconv.ParseUint(value, 10, 32)
+        if err != nil {
+            return fmt.Errorf("%q is not a number", value)
+        }
+        target.SetUint(n)
+    case reflect.Slice:
+        var list []string
+        for _, item := range strings.Split(value, ",") {
+            if item = strings.TrimSpace(item); item != "" {
+                list = append(list, item)
+            }
+        }
+        target.Set(reflect.ValueOf(list))
+    case reflect.Map:
+        var settings struct{ Settings map[string]interface{} }
+        if _, err := toml.Decode("Settings = {"+value+"}", &settings); err != nil {
+            return fmt.Errorf("%q is not a list of name = value: %v", value, err)
+        }
+        if target.IsNil() {
+            target.Set(reflect.MakeMap(target.Type()))
+        }
+        for name, setting := range settings.Settings {
+            target.SetMapIndex(reflect.ValueOf(name), reflect.ValueOf(setting))
+        }
+    default:
+        return fmt.Errorf("%s can't be overridden", field.name())
+    }
+    return nil
+}
+
+// readSecret reads a value from a file, without the trailing newline most
+// editors and `echo` add.
+func readSecret(file string) (string, error) {
+    b, err := ioutil.ReadFile(file)
+    if err != nil {
+        return "", err
+    }
+    return strings.TrimRight(string(b), "\r\n"), nil
+}
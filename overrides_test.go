@@ -0,0 +1,268 @@
+package main
+
+import (
+    "flag"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestSplitCamelCase(t *testing.T) {
+    tests := []struct {
+        in string
+        want []string
+    }{
+        {"Role", []string{"role"}},
+        {"DatabaseName", []string{"database", "name"}},
+        {"HTTPServer", []string{"http", "server"}},
+        {"SSLKeyFile", []string{"ssl", "key", "file"}},
+        {"SSLRootCert", []string{"ssl", "root", "cert"}},
+        {"PGFS", []string{"pgfs"}},
+        {"PGFSMaxConns", []string{"pgfs", "max", "conns"}},
+        {"EmbeddedPostgresRuntimePath", []string{"embedded", "postgres", "runtime", "path"}},
+    }
+    for _, test := range tests {
+        if got := splitCamelCase(test.in); !reflect.DeepEqual(got, test.want) {
+            t.Errorf("splitCamelCase(%q) = %q, want %q", test.in, got, test.want)
+        }
+    }
+}
+
+func TestConfigFieldNames(t *testing.T) {
+    tests := []struct {
+        path string
+        flagName string
+        envName string
+    }{
+        {"Database.Password", "database-password", "AQUAMETA_DATABASE_PASSWORD"},
+        {"Database.Pool.MaxConns", "database-pool-max-conns", "AQUAMETA_DATABASE_POOL_MAX_CONNS"},
+        {"HTTPServer.SSLKeyFile", "http-server-ssl-key-file", "AQUAMETA_HTTP_SERVER_SSL_KEY_FILE"},
+        {"HTTPServer.Compression.Encodings", "http-server-compression-encodings", "AQUAMETA_HTTP_SERVER_COMPRESSION_ENCODINGS"},
+    }
+    for _, test := range tests {
+        field := configField{Path: strings.Split(test.path, ".")}
+        if got := field.flagName(); got != test.flagName {
+            t.Errorf("%s: flag %q, want %q", test.path, got, test.flagName)
+        }
+        if got := field.envName(); got != test.envName {
+            t.Errorf("%s: environment variable %q, want %q", test.path, got, test.envName)
+        }
+    }
+}
+
+func TestConfigFields(t *testing.T) {
+    fields := make(map[string]configField)
+    for _, field := range configFields() {
+        fields[field.name()] = field
+    }
+    for _, name := range []string{"Database.Password", "Database.Pool.MaxConns", "Database.Settings", "HTTPServer.Compression.Encodings", "PGFS.Enabled"} {
+        if _, ok := fields[name]; !ok {
+            t.Errorf("%s can't be overridden", name)
+        }
+    }
+    // the config file's own File variant is read by applyConfigOverrides, not
+    // overridden, and Bundles is only set in the file
+    for _, name := range []string{"Database.PasswordFile", "Bundles.Sources"} {
+        if _, ok := fields[name]; ok {
+            t.Errorf("%s can be overridden", name)
+        }
+    }
+    for name, field := range fields {
+        if field.hasFileVariant() != secretFields[name] {
+            t.Errorf("%s has a File variant: %v", name, field.hasFileVariant())
+        }
+    }
+}
+
+// setenv sets an environment variable for the rest of the test.
+func setenv(t *testing.T, name, value string) {
+    old, ok := os.LookupEnv(name)
+    os.Setenv(name, value)
+    t.Cleanup(func() {
+        if ok {
+            os.Setenv(name, old)
+        } else {
+            os.Unsetenv(name)
+        }
+    })
+}
+
+func TestApplyConfigOverrides(t *testing.T) {
+    dir := t.TempDir()
+    secret := func(name, content string) string {
+        file := filepath.Join(dir, name)
+        if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+            t.Fatal(err)
+        }
+        return file
+    }
+    flagSecret := secret("flag", "from a flag file\n")
+    envSecret := secret("env", "from an env file\r\n")
+    configSecret := secret("config", "from the config's file\n")
+
+    tests := []struct {
+        name string
+        config tomlConfig
+        args []string
+        env map[string]string
+        check func(tomlConfig) interface{}
+        want interface{}
+        err string
+    }{
+        {
+            name: "none",
+            config: tomlConfig{Database: Database{Password: "from the config"}},
+            check: func(c tomlConfig) interface{} { return c.Database.Password },
+            want: "from the config",
+        },
+        {
+            name: "config file's PasswordFile",
+            config: tomlConfig{Database: Database{Password: "from the config", PasswordFile: configSecret}},
+            check: func(c tomlConfig) interface{} { return c.Database.Password },
+            want: "from the config's file",
+        },
+        {
+            name: "env file over PasswordFile",
+            config: tomlConfig{Database: Database{PasswordFile: configSecret}},
+            env: map[string]string{"AQUAMETA_DATABASE_PASSWORD_FILE": envSecret},
+            check: func(c tomlConfig) interface{} { return c.Database.Password },
+            want: "from an env file",
+        },
+        {
+            name: "env over env file",
+            env: map[string]string{"AQUAMETA_DATABASE_PASSWORD_FILE": envSecret, "AQUAMETA_DATABASE_PASSWORD": "from the env"},
+            check: func(c tomlConfig) interface{} { return c.Database.Password },
+            want: "from the env",
+        },
+        {
+            name: "flag file over env",
+            args: []string{"-database-password-file", flagSecret},
+            env: map[string]string{"AQUAMETA_DATABASE_PASSWORD": "from the env"},
+            check: func(c tomlConfig) interface{} { return c.Database.Password },
+            want: "from a flag file",
+        },
+        {
+            name: "flag over flag file",
+            args: []string{"-database-password-file", flagSecret, "-database-password", "from a flag"},
+            check: func(c tomlConfig) interface{} { return c.Database.Password },
+            want: "from a flag",
+        },
+        {
+            name: "uint32",
+            args: []string{"-database-port", "5433"},
+            check: func(c tomlConfig) interface{} { return c.Database.Port },
+            want: uint32(5433),
+        },
+        {
+            name: "bool flag without a value",
+            args: []string{"-pgfs-enabled"},
+            check: func(c tomlConfig) interface{} { return c.PGFS.Enabled },
+            want: true,
+        },
+        {
+            name: "bool from the env",
+            config: tomlConfig{PGFS: PGFS{Enabled: true}},
+            env: map[string]string{"AQUAMETA_PGFS_ENABLED": "false"},
+            check: func(c tomlConfig) interface{} { return c.PGFS.Enabled },
+            want: false,
+        },
+        {
+            name: "nested int32",
+            args: []string{"-database-pool-max-conns", "20"},
+            check: func(c tomlConfig) interface{} { return c.Database.Pool.MaxConns },
+            want: int32(20),
+        },
+        {
+            name: "nested int",
+            env: map[string]string{"AQUAMETA_HTTP_SERVER_COMPRESSION_MIN_SIZE": "512"},
+            check: func(c tomlConfig) interface{} { return c.HTTPServer.Compression.MinSize },
+            want: 512,
+        },
+        {
+            name: "list",
+            args: []string{"-http-server-compression-encodings", "br, gzip,"},
+            check: func(c tomlConfig) interface{} { return c.HTTPServer.Compression.Encodings },
+            want: []string{"br", "gzip"},
+        },
+        {
+            name: "settings merged over the config file's",
+            config: tomlConfig{Database: Database{Settings: map[string]interface{}{"lock_timeout": "10s", "work_mem": "4MB"}}},
+            env: map[string]string{"AQUAMETA_DATABASE_SETTINGS": `lock_timeout = "5s", statement_timeout = 0`},
+            check: func(c tomlConfig) interface{} { return c.Database.Settings },
+            want: map[string]interface{}{"lock_timeout": "5s", "work_mem": "4MB", "statement_timeout": int64(0)},
+        },
+        {
+            name: "settings without any in the config file",
+            args: []string{"-database-server-settings", `wal_level = "logical"`},
+            check: func(c tomlConfig) interface{} { return c.Database.ServerSettings },
+            want: map[string]interface{}{"wal_level": "logical"},
+        },
+        {
+            name: "invalid number",
+            args: []string{"-database-port", "postgres"},
+            err: `-database-port: "postgres" is not a number`,
+        },
+        {
+            name: "out of range",
+            env: map[string]string{"AQUAMETA_DATABASE_POOL_MAX_CONNS": "3000000000"},
+            err: `AQUAMETA_DATABASE_POOL_MAX_CONNS: "3000000000" is not a number`,
+        },
+        {
+            name: "invalid bool",
+            args: []string{"-pgfs-enabled=maybe"},
+            err: `-pgfs-enabled: "maybe" is not true or false`,
+        },
+        {
+            name: "invalid settings",
+            args: []string{"-database-settings", "lock_timeout"},
+            err: "-database-settings: ",
+        },
+        {
+            name: "missing secret file",
+            env: map[string]string{"AQUAMETA_DATABASE_PASSWORD_FILE": filepath.Join(dir, "missing")},
+            err: "AQUAMETA_DATABASE_PASSWORD_FILE: ",
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            for name, value := range test.env {
+                setenv(t, name, value)
+            }
+            flags := flag.NewFlagSet("test", flag.ContinueOnError)
+            addConfigFlags(flags)
+            if err := flags.Parse(test.args); err != nil {
+                t.Fatal(err)
+            }
+
+            config := test.config
+            err := applyConfigOverrides(flags, &config)
+            if test.err != "" {
+                if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+                    t.Fatalf("error %v, want %q", err, test.err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got := test.check(config); !reflect.DeepEqual(got, test.want) {
+                t.Errorf("got %#v, want %#v", got, test.want)
+            }
+        })
+    }
+}
+
+func TestHasConfigOverrides(t *testing.T) {
+    flags := flag.NewFlagSet("test", flag.ContinueOnError)
+    addConfigFlags(flags)
+    if hasConfigOverrides(flags) {
+        t.Fatal("overridden without flags or environment variables")
+    }
+    setenv(t, "AQUAMETA_DATABASE_MODE", "standalone")
+    if !hasConfigOverrides(flags) {
+        t.Fatal("AQUAMETA_DATABASE_MODE isn't an override")
+    }
+}
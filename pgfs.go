@@ -6,10 +6,11 @@ import (
     "log"
     "os"
     "fmt"
+    "sync"
     "syscall"
 
     "github.com/jackc/pgx/v4/pgxpool"
-    // "github.com/jackc/pgx/v4"
+    "github.com/jackc/pgx/v4"
     "github.com/lib/pq"
 
     "bazil.org/fuse"
@@ -17,12 +18,20 @@ import (
 )
 
 
+// pgfs mounts and serves the filesystem until it's unmounted.  It always
+// sends on fuseDone when it returns: true if the filesystem was mounted and
+// has stopped, false if it never mounted and the server carries on without it.
 func pgfs(config tomlConfig, dbpool *pgxpool.Pool, fuseDone chan bool) {
+    mounted := false
+    defer func() { fuseDone <- mounted }()
+
     if ! config.PGFS.Enabled {
+        setPGFSState("disabled")
         log.Printf("PGFS is not enabled.")
     } else {
 
         log.Printf("Mounting PGFS Filesystem: %s\n\n", config.PGFS.MountDirectory)
+        setPGFSState("mounting")
 
         c, err := fuse.Mount(
             config.PGFS.MountDirectory,
@@ -30,16 +39,30 @@ func pgfs(config tomlConfig, dbpool *pgxpool.Pool, fuseDone chan bool) {
             fuse.Subtype("pgfs"),
         )
         if err != nil {
-            log.Fatal(err)
+            log.Printf("Unable to mount PGFS at %s, continuing without it: %v", config.PGFS.MountDirectory, err)
+            setPGFSState("failed")
+            return
         }
         defer c.Close()
+        setPGFSState("mounted")
+        mounted = true
 
         err = fs.Serve(c, FS{dbpool: dbpool})
         if err != nil {
-            log.Fatal(err)
+            log.Printf("PGFS stopped: %v", err)
         }
+        setPGFSState("stopped")
+    }
+}
 
-        fuseDone <- true
+// unmountPGFS unmounts the filesystem, which ends pgfs()'s fs.Serve.
+func unmountPGFS(config tomlConfig) {
+    if !config.PGFS.Enabled {
+        return
+    }
+    log.Printf("Unmounting PGFS Filesystem: %s", config.PGFS.MountDirectory)
+    if err := fuse.Unmount(config.PGFS.MountDirectory); err != nil {
+        log.Printf("Unable to unmount PGFS: %v", err)
     }
 }
 
@@ -76,11 +99,11 @@ func (Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 
 func (d Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
     var exists bool
-    q := fmt.Sprintf("select exists(select 1 from meta.schema where name=%s)", pq.QuoteLiteral(name))
-    err := d.fs.dbpool.QueryRow(context.Background(), q).Scan(&exists)
+    q := "select exists(select 1 from meta.schema where name=$1)"
+    err := d.fs.dbpool.QueryRow(context.Background(), q, name).Scan(&exists)
     if err != nil {
         log.Println("Dir Lookup: Error querying database: ", err)
-        return nil, fuse.ENOENT
+        return nil, fuse.EIO
     }
     if exists {
         return SchemaDir{d.fs, name}, nil
@@ -90,11 +113,12 @@ func (d Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 }
 
 func (d Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-    q := fmt.Sprintf("select name from meta.schema")
+    q := "select name from meta.schema"
     rows, err := d.fs.dbpool.Query(context.Background(), q)
 
     if err != nil {
-        log.Fatal("Dir ReadDirAll: Error querying database: ", err)
+        log.Println("Dir ReadDirAll: Error querying database: ", err)
+        return nil, fuse.EIO
     }
     defer rows.Close()
 
@@ -104,8 +128,8 @@ func (d Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
         err := rows.Scan(&name)
         if err != nil {
-            log.Fatal("Dir ReadDirAll: Error scanning row", err)
-            continue
+            log.Println("Dir ReadDirAll: Error scanning row", err)
+            return nil, fuse.EIO
         }
 
         // log.Println("Schema:", name)
@@ -118,7 +142,8 @@ func (d Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
 
     if rows.Err() != nil {
-        log.Fatal("Dir ReadDirAll: Error iterating rows", rows.Err())
+        log.Println("Dir ReadDirAll: Error iterating rows", rows.Err())
+        return nil, fuse.EIO
     }
 
     return append(dirDirs,
@@ -148,16 +173,14 @@ func (d SchemaDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
     var exists bool
     var pk_column_name string
 
-    pkQ := fmt.Sprintf("select (primary_key_column_ids[1]).name as pk_column_name from meta.relation where schema_name=%s and name=%s and primary_key_column_ids is not null",
-        pq.QuoteLiteral(d.schema_name),
-        pq.QuoteLiteral(name))
+    pkQ := "select (primary_key_column_ids[1]).name as pk_column_name from meta.relation where schema_name=$1 and name=$2 and primary_key_column_ids is not null"
 
     // check that relation exists
     existsQ := fmt.Sprintf("select exists(%s)", pkQ)
-    err := d.fs.dbpool.QueryRow(context.Background(), existsQ).Scan(&exists)
+    err := d.fs.dbpool.QueryRow(context.Background(), existsQ, d.schema_name, name).Scan(&exists)
     if err != nil {
-        log.Fatal("Error in SchemaDir Lookup exists: ", err)
-        return nil, fuse.ENOENT
+        log.Println("Error in SchemaDir Lookup exists: ", err)
+        return nil, fuse.EIO
     }
 
     if !exists {
@@ -165,21 +188,21 @@ func (d SchemaDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
     }
 
     // get its primary key, for use as variable in TableDir struct
-    err = d.fs.dbpool.QueryRow(context.Background(), pkQ).Scan(&pk_column_name)
+    err = d.fs.dbpool.QueryRow(context.Background(), pkQ, d.schema_name, name).Scan(&pk_column_name)
     if err != nil {
-        log.Fatal("Error in SchemaDir Lookup pk query: ", err)
-        return nil, fuse.ENOENT
+        log.Println("Error in SchemaDir Lookup pk query: ", err)
+        return nil, fuse.EIO
     }
     return TableDir{d.fs, d.schema_name, name, pk_column_name}, nil
 }
 
 func (d SchemaDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-     q := fmt.Sprintf("select name from meta.relation where schema_name=%s and primary_key_column_ids is not null",
-         pq.QuoteLiteral(d.schema_name))
-    rows, err := d.fs.dbpool.Query(context.Background(), q)
+    q := "select name from meta.relation where schema_name=$1 and primary_key_column_ids is not null"
+    rows, err := d.fs.dbpool.Query(context.Background(), q, d.schema_name)
 
     if err != nil {
-        log.Fatal("SchemaDir ReadDirAll(): Error querying database: ", err)
+        log.Println("SchemaDir ReadDirAll(): Error querying database: ", err)
+        return nil, fuse.EIO
     }
     defer rows.Close()
 
@@ -189,8 +212,8 @@ func (d SchemaDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
         err := rows.Scan(&name)
         if err != nil {
-            log.Fatal("SchemaDir ReadDirAll(): Error scanning row", err)
-            continue
+            log.Println("SchemaDir ReadDirAll(): Error scanning row", err)
+            return nil, fuse.EIO
         }
 
         // log.Println("Relation: ", name)
@@ -202,7 +225,8 @@ func (d SchemaDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
     }
 
     if rows.Err() != nil {
-        log.Fatal("SchemaDir ReadDirAll(): Error iterating rows", rows.Err())
+        log.Println("SchemaDir ReadDirAll(): Error iterating rows", rows.Err())
+        return nil, fuse.EIO
     }
 
     return append(dirDirs,
@@ -232,15 +256,14 @@ func (TableDir) Attr(ctx context.Context, a *fuse.Attr) error {
 
 func (d TableDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
     var exists bool
-    q := fmt.Sprintf("select exists(select 1 from %s.%s where %s::text=%s)",
+    q := fmt.Sprintf("select exists(select 1 from %s.%s where %s::text=$1)",
         pq.QuoteIdentifier(d.schema_name),
         pq.QuoteIdentifier(d.table_name),
-        pq.QuoteIdentifier(d.pk_column_name),
-        pq.QuoteLiteral(name))
-    err := d.fs.dbpool.QueryRow(context.Background(), q).Scan(&exists)
+        pq.QuoteIdentifier(d.pk_column_name))
+    err := d.fs.dbpool.QueryRow(context.Background(), q, name).Scan(&exists)
     if err != nil {
         log.Println("TableDir Lookup(): Error querying database: ", err)
-        return nil, fuse.ENOENT
+        return nil, fuse.EIO
     }
     if exists {
         return RowDir{d.fs, d.schema_name, d.table_name, d.pk_column_name, name}, nil
@@ -256,7 +279,8 @@ func (d TableDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
     rows, err := d.fs.dbpool.Query(context.Background(), q)
     if err != nil {
-        log.Fatal("TableDir ReadDirAll(): Error querying database: ", err)
+        log.Println("TableDir ReadDirAll(): Error querying database: ", err)
+        return nil, fuse.EIO
     }
     defer rows.Close()
 
@@ -266,8 +290,8 @@ func (d TableDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
         err := rows.Scan(&pk_value)
         if err != nil {
-            log.Fatal("TableDir ReadDirAll(): Error scanning row", err)
-            continue
+            log.Println("TableDir ReadDirAll(): Error scanning row", err)
+            return nil, fuse.EIO
         }
 
         // log.Println("Primary Key:", pk_value)
@@ -279,7 +303,8 @@ func (d TableDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
     }
 
     if rows.Err() != nil {
-        log.Fatal("TableDir ReadDirAll(): Error iterating rows", rows.Err())
+        log.Println("TableDir ReadDirAll(): Error iterating rows", rows.Err())
+        return nil, fuse.EIO
     }
 
     return dirDirs, nil
@@ -319,30 +344,28 @@ func (d RowDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
     var rowExists bool
 
     // check that this column exists (we could probably make this a lot faster by sending garbage queries to the db)
-    existsQ := fmt.Sprintf("select exists(select 1 from meta.relation_column where schema_name=%s and relation_name=%s and name=%s)",
-        pq.QuoteLiteral(d.schema_name),
-        pq.QuoteLiteral(d.table_name),
-        pq.QuoteLiteral(name))
+    existsQ := "select exists(select 1 from meta.relation_column where schema_name=$1 and relation_name=$2 and name=$3)"
     // log.Println("existsQ", existsQ)
 
-    err := d.fs.dbpool.QueryRow(context.Background(), existsQ).Scan(&columnExists)
+    err := d.fs.dbpool.QueryRow(context.Background(), existsQ, d.schema_name, d.table_name, name).Scan(&columnExists)
     if err != nil {
-        log.Fatal("RowDir Lookup(): Error in column exists check: ", err)
+        log.Println("RowDir Lookup(): Error in column exists check: ", err)
+        return nil, fuse.EIO
     }
     if !columnExists {
         return nil, fuse.ENOENT
     }
 
     // check that row exists
-    q := fmt.Sprintf("select exists(select %s from %s.%s where %s::text=%s)",
+    q := fmt.Sprintf("select exists(select %s from %s.%s where %s::text=$1)",
         pq.QuoteIdentifier(name),
         pq.QuoteIdentifier(d.schema_name),
         pq.QuoteIdentifier(d.table_name),
-        pq.QuoteIdentifier(d.pk_column_name),
-        pq.QuoteLiteral(d.pk_value))
-    err = d.fs.dbpool.QueryRow(context.Background(), q).Scan(&rowExists)
+        pq.QuoteIdentifier(d.pk_column_name))
+    err = d.fs.dbpool.QueryRow(context.Background(), q, d.pk_value).Scan(&rowExists)
     if err != nil {
-        log.Fatal("RowDir Lookup(): Error in row exists check: ", err)
+        log.Println("RowDir Lookup(): Error in row exists check: ", err)
+        return nil, fuse.EIO
     }
     if !rowExists {
         return nil, fuse.ENOENT
@@ -362,13 +385,12 @@ func (d RowDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 
 
 func (d RowDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-     q := fmt.Sprintf("select name as column_name from meta.column where schema_name=%s and relation_name=%s",
-         pq.QuoteLiteral(d.schema_name),
-         pq.QuoteLiteral(d.table_name))
-    rows, err := d.fs.dbpool.Query(context.Background(), q)
+    q := "select name as column_name from meta.column where schema_name=$1 and relation_name=$2"
+    rows, err := d.fs.dbpool.Query(context.Background(), q, d.schema_name, d.table_name)
 
     if err != nil {
-        log.Fatal("RowDir ReadDirAll(): Error querying database: ", err)
+        log.Println("RowDir ReadDirAll(): Error querying database: ", err)
+        return nil, fuse.EIO
     }
     defer rows.Close()
 
@@ -378,8 +400,8 @@ func (d RowDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
         err := rows.Scan(&column_name)
         if err != nil {
-            log.Fatal("RowDir ReadDirAll(): Error scanning row: ", err)
-            continue
+            log.Println("RowDir ReadDirAll(): Error scanning row: ", err)
+            return nil, fuse.EIO
         }
 
         // log.Println("Schema:", column_name)
@@ -391,7 +413,8 @@ func (d RowDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
     }
 
     if rows.Err() != nil {
-        log.Fatal("RowDir ReadDirAll(): Error iterating rows", rows.Err())
+        log.Println("RowDir ReadDirAll(): Error iterating rows", rows.Err())
+        return nil, fuse.EIO
     }
 
     return append(dirDirs,
@@ -403,7 +426,10 @@ func (d RowDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 //
 // FieldFile
 //
+
+// data written to each field since its last flush, keyed by schema/table/pk/column
 var fileBuffers = make(map[string]string)
+var fileBuffersMu sync.Mutex
 
 type FieldFile struct{
     fs FS
@@ -417,19 +443,23 @@ type FieldFile struct{
 func (ff FieldFile) Attr(ctx context.Context, a *fuse.Attr) error {
     var octet_length int
 
-    q := fmt.Sprintf("select coalesce(octet_length(%s::text)::integer, 0) as octet_length from %s.%s where %s = %s",
+    q := fmt.Sprintf("select coalesce(octet_length(%s::text)::integer, 0) as octet_length from %s.%s where %s = $1",
          pq.QuoteIdentifier(ff.column_name),
          pq.QuoteIdentifier(ff.schema_name),
          pq.QuoteIdentifier(ff.table_name),
-         pq.QuoteIdentifier(ff.pk_column_name),
-         pq.QuoteLiteral(ff.pk_value))
+         pq.QuoteIdentifier(ff.pk_column_name))
 
     // fmt.Println(q)
 
-    err := ff.fs.dbpool.QueryRow(context.Background(), q).Scan(&octet_length)
+    err := ff.fs.dbpool.QueryRow(context.Background(), q, ff.pk_value).Scan(&octet_length)
 
+    // the row was deleted since it was looked up
+    if err == pgx.ErrNoRows {
+        return fuse.ENOENT
+    }
     if err != nil {
-        log.Fatal("FileField Attr(): Error querying database: ", err)
+        log.Println("FileField Attr(): Error querying database: ", err)
+        return fuse.EIO
     }
 
     a.Inode = 2
@@ -444,17 +474,20 @@ func (ff FieldFile) Attr(ctx context.Context, a *fuse.Attr) error {
 func (ff FieldFile) ReadAll(ctx context.Context) ([]byte, error) {
     var content string
 
-    q := fmt.Sprintf("select %s::text as content from %s.%s where %s = %s",
+    q := fmt.Sprintf("select %s::text as content from %s.%s where %s = $1",
          pq.QuoteIdentifier(ff.column_name),
          pq.QuoteIdentifier(ff.schema_name),
          pq.QuoteIdentifier(ff.table_name),
-         pq.QuoteIdentifier(ff.pk_column_name),
-         pq.QuoteLiteral(ff.pk_value))
+         pq.QuoteIdentifier(ff.pk_column_name))
 
-    err := ff.fs.dbpool.QueryRow(context.Background(), q).Scan(&content)
+    err := ff.fs.dbpool.QueryRow(context.Background(), q, ff.pk_value).Scan(&content)
 
+    if err == pgx.ErrNoRows {
+        return nil, fuse.ENOENT
+    }
     if err != nil {
-        log.Fatal("FileField ReadDirAll(): Error querying database: ", err)
+        log.Println("FileField ReadAll(): Error querying database: ", err)
+        return nil, fuse.EIO
     }
 
     return []byte(content), nil
@@ -469,7 +502,9 @@ func (ff FieldFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fus
     */
 
     var key = ff.schema_name+"/"+ff.table_name+"/"+ff.pk_value+"/"+ff.column_name
+    fileBuffersMu.Lock()
     fileBuffers[key] = fileBuffers[key] + string(req.Data)
+    fileBuffersMu.Unlock()
 
     resp.Size = len(req.Data)
 	return nil
@@ -477,50 +512,43 @@ func (ff FieldFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fus
 
 
 func (ff FieldFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+    return ff.writeBuffer()
+}
+
+
+// Flush is called on every close() of the file, so buffered writes land in
+// the database even when the writer never calls fsync.
+func (ff FieldFile) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+    return ff.writeBuffer()
+}
+
+
+// writeBuffer updates the field with the data written since the last flush.
+func (ff FieldFile) writeBuffer() error {
     var key = ff.schema_name+"/"+ff.table_name+"/"+ff.pk_value+"/"+ff.column_name
 
-    // log.Printf("!!!!!!!! Fsync called:\n    fileBuffers[%s] %s", key, fileBuffers[key]);
+    // log.Printf("!!!!!!!! writeBuffer called:\n    fileBuffers[%s] %s", key, fileBuffers[key]);
 
-    q := fmt.Sprintf("update %s.%s set %s = %s where %s = %s",
+    fileBuffersMu.Lock()
+    buffer, written := fileBuffers[key]
+    delete(fileBuffers, key)
+    fileBuffersMu.Unlock()
+    if !written {
+        return nil
+    }
+
+    q := fmt.Sprintf("update %s.%s set %s = $1 where %s = $2",
          pq.QuoteIdentifier(ff.schema_name),
          pq.QuoteIdentifier(ff.table_name),
          pq.QuoteIdentifier(ff.column_name),
-         pq.QuoteLiteral(fileBuffers[key]),
-         pq.QuoteIdentifier(ff.pk_column_name),
-         pq.QuoteLiteral(ff.pk_value))
-    _, err := ff.fs.dbpool.Exec(context.Background(), q)
+         pq.QuoteIdentifier(ff.pk_column_name))
+    _, err := ff.fs.dbpool.Exec(context.Background(), q, buffer, ff.pk_value)
 
     // log.Println("Fsync field update q: ",q)
     if err != nil {
-        // Handle error
-        log.Printf("FieldFile Flush(): update stmt failed. ",q,err)
-    }
-    fileBuffers[key] = ""
-
-    return nil
-}
-
-
-func (ff FieldFile) Flush(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-    log.Fatal("######## Flush() called and we don't know what this does.")
-
-/*
-    fs.mu.Lock()
-    defer fs.mu.Unlock()
-
-    q := fmt.sprintf("update %s.%s set %s = %s where %s = %s",
-         pq.quoteidentifier(ff.schema_name),
-         pq.quoteidentifier(ff.table_name),
-         pq.quoteidentifier(ff.column_name),
-         pq.quoteliteral(string(req.data)),
-         pq.quoteidentifier(ff.pk_column_name),
-         pq.quoteliteral(ff.pk_value))
-    _, err := ff.fs.dbpool.exec(context.background(), q)
-    if err != nil {
-        // handle error
-        log.printf("fieldfile flush(): update stmt failed. ",q,err)
+        log.Printf("FieldFile writeBuffer(): update stmt failed: %s %v", q, err)
+        return fuse.EIO
     }
-*/
 
     return nil
 }
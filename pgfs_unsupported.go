@@ -6,8 +6,17 @@ import (
   "log"
 )
 
+// pgfs never mounts here, so it sends false on fuseDone right away.
 func pgfs(config tomlConfig, dbpool *pgxpool.Pool, fuseDone chan bool) {
+    defer func() { fuseDone <- false }()
+
 	if config.PGFS.Enabled {
+        setPGFSState("unsupported")
         log.Printf("PGFS Filesystem uses the bazil.org/fuse library which supports Linux and FreeBSD only.\n\n")
+    } else {
+        setPGFSState("disabled")
     }
 }
+
+func unmountPGFS(config tomlConfig) {
+}
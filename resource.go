@@ -3,22 +3,28 @@ package main
 import (
     "context"
     "encoding/json"
+    "errors"
     "fmt"
+    "github.com/jackc/pgconn"
+    "github.com/jackc/pgx/v4"
     "github.com/jackc/pgx/v4/pgxpool"
     "github.com/lib/pq"
     "io"
     "log"
     "net/http"
     "net/url"
+    "strings"
+    "time"
 )
 
-func resource(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Request) {
+func resource(dbpool *pgxpool.Pool, routes *routeTable, compression *compressor) func(w http.ResponseWriter, req *http.Request) {
     /*
      * resource handler
      *
      * 1. count the number of matching paths in
      *   - endpoint.resource
      *   - endpoint.resource_binary
+     *   - endpoint.resource_function
      *   - endpoint.template_route
      * if count > 1, throw a 300 multiple choices
      * if count < 1, throw 404 not found
@@ -32,72 +38,40 @@ func resource(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
         // path := strings.SplitN(req.RequestURI,"?", 2)[0]
         path, err := url.QueryUnescape(req.URL.Path)
         if err != nil {
-            log.Fatal(err)
+            http.Error(w, "Malformed path: "+err.Error(), http.StatusBadRequest)
+            return
         }
 
+        // run as the session's role
+        ctx := context.Background()
+        role := sessionRole(ctx, dbpool, req)
+        tx, err := beginAs(ctx, dbpool, role)
+        if err != nil {
+            log.Printf("Unable to begin request transaction as %s: %v", role, err)
+            http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+            return
+        }
+        // resource functions may write, so commit whatever the request did
+        defer tx.Commit(ctx)
+
         // query string
         /*
            m, err := url.ParseQuery(req.URL.RawQuery)
            if err != nil { log.Fatal(err) }
         */
 
-        // count matching endpoint.resource
-        // TODO: Learn to work with UUIDs in Go
-        const matchCountQ = `
-            select r.id::text, 'resource' as resource_table
-            from endpoint.resource r
-            where path = %v
-            and active = true
-
-            union
-
-            select r.id::text, 'resource_binary'
-            from endpoint.resource_binary r
-            where path = %v
-            and active = true
-
-            union
-
-            select r.id::text, 'resource_function'
-            from endpoint.resource_function r
-            -- 1. rewrite path_pattern to a regex:
-            --     /blog/{$1}/article/{$2} goes to ^/blog/([^\/\s]+)/article/([^\/\s]+)$
-            -- 2. match against the request path
-            where %v ~ regexp_replace('^' || r.path_pattern || '$', '\${\d+}', '([^\/\s]+)', 'g')`
-
-        /*
-           union
-
-           select r.id::text, 'template'
-           from endpoint.template_route r
-           where %v ~ r.url_pattern`
-           // and active = true ?
-        */
-
-        matches, err := dbpool.Query(context.Background(), fmt.Sprintf(
-            matchCountQ,
-            pq.QuoteLiteral(path),
-            pq.QuoteLiteral(path),
-            pq.QuoteLiteral(path)))
-
-        if err != nil {
-			log.Printf("Resource matching query failed: %v", err)
-			return
-        }
-        defer matches.Close()
-
-
-        var id string
-        var resourceTable string
-
-        var n int32
-        for matches.Next() {
-            err = matches.Scan(&id, &resourceTable)
+        // match the path against the route table, or in the database if
+        // the table isn't usable right now
+        matches, ok := routes.lookup(path)
+        if !ok {
+            matches, err = matchRoutes(ctx, tx, path)
             if err != nil {
-                return // FIXME
+                log.Printf("Resource matching query failed: %v", err)
+                http.Error(w, http.StatusText(httpStatus(err)), httpStatus(err))
+                return
             }
-            n++
         }
+        n := len(matches)
 
         // 300 Multiple Choices
         if n > 1 {
@@ -114,41 +88,14 @@ func resource(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
 
         // 200 OK
         // get the resource/resource_binary/resource_function, process it and return the results
+        id, resourceTable := matches[0].id, matches[0].table
         var content string
-        var contentBinary []byte
         var mimetype string
         var headers []byte
 
         switch resourceTable {
-        case "resource":
-            const resourceQ = `
-                select r.content, m.mimetype
-                from endpoint.resource r
-                    join endpoint.mimetype m on r.mimetype_id = m.id
-                where r.id = %v`
-
-            err := dbpool.QueryRow(context.Background(), fmt.Sprintf(resourceQ, pq.QuoteLiteral(id))).Scan(&content, &mimetype)
-            if err != nil {
-                log.Printf("QueryRow failed: %v", err)
-            }
-            w.Header().Set("Content-Type", mimetype)
-            w.WriteHeader(200)
-            io.WriteString(w, content)
-
-        case "resource_binary":
-            const resourceBinaryQ = `
-               select r.content, m.mimetype
-               from endpoint.resource_binary r
-                   join endpoint.mimetype m on r.mimetype_id = m.id
-               where r.id = %v`
-
-            err := dbpool.QueryRow(context.Background(), fmt.Sprintf(resourceBinaryQ, pq.QuoteLiteral(id))).Scan(&contentBinary, &mimetype)
-            if err != nil {
-                log.Printf("QueryRow failed: %v", err)
-            }
-            w.Header().Set("Content-Type", mimetype)
-            w.WriteHeader(200)
-            w.Write(contentBinary)
+        case "resource", "resource_binary":
+            serveResource(ctx, w, req, dbpool, role, tx, resourceTable, id, compression)
 
         case "resource_function":
             // get the endpoint.resource_function row, propagate path_pattern, defalt_args and mimetype
@@ -160,13 +107,13 @@ func resource(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
                     (rf.function_id).parameters as function_parameters,
                     rf.default_args as default_args,
                     m.mimetype,
-                    regexp_match(%v, regexp_replace('^' || rf.path_pattern || '$', '\${\d+}', '([^\/\s]+)', 'g')) as args,
+                    regexp_match($1, regexp_replace('^' || rf.path_pattern || '$', '\${\d+}', '([^\/\s]+)', 'g')) as args,
                     (select array_agg(m[1]::integer) from regexp_matches(rf.path_pattern, '\${(\d+)}', 'g') m),
                     mf.return_type = 'record' as returns_record
                 from endpoint.resource_function rf
                     join endpoint.mimetype m on rf.mimetype_id = m.id
                     join meta.function mf on mf.id=rf.function_id
-                where rf.id = %v`
+                where rf.id = $2`
 
             var function_parameters []string
             var default_args []string
@@ -177,10 +124,20 @@ func resource(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
             var path_arg_positions []int
             var returns_record bool
 
-            err := dbpool.QueryRow(context.Background(),
-                fmt.Sprintf(resourceFunctionPrepQ, pq.QuoteLiteral(path), pq.QuoteLiteral(id))).Scan(&path_pattern, &schema_name, &function_name, &function_parameters, &default_args, &mimetype, &path_args, &path_arg_positions, &returns_record)
+            err := tx.QueryRow(ctx, resourceFunctionPrepQ, path, id).Scan(&path_pattern, &schema_name, &function_name, &function_parameters, &default_args, &mimetype, &path_args, &path_arg_positions, &returns_record)
             if err != nil {
                 log.Printf("QueryRow failed: %v", err)
+                http.Error(w, http.StatusText(httpStatus(err)), httpStatus(err))
+                return
+            }
+
+            // the route table matched path with Go's regexp, which can disagree
+            // with PostgreSQL's about a pattern; if PostgreSQL's didn't match
+            // (or has captures of its own), there's nothing to call
+            if len(path_args) != len(path_arg_positions) {
+                log.Printf("endpoint.resource_function %s: path_pattern %q doesn't match %q in PostgreSQL", id, path_pattern, path)
+                http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+                return
             }
 
             // args is the array of strings to be cast to their appropriate type and passed to the function
@@ -194,11 +151,13 @@ func resource(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
                 args[path_arg_positions[i]-1] = path_args[i]
             }
 
-            // build the function's argument string
+            // build the function call, args are passed as bind parameters cast to the parameter types
             var function_call_str = pq.QuoteIdentifier(schema_name)+"."+pq.QuoteIdentifier(function_name)+"("
+            var function_args = make([]interface{}, len(function_parameters))
             for i := 0; i<len(function_parameters);i++ {
                 // not using pq.QuoteIdentifier for function_parametrs[i] here because e.g. integer is an alias for int4, but if you quote it, it uses only and exactly the literal type name.  FIXME?
-                function_call_str += pq.QuoteLiteral(args[i]) + "::" + function_parameters[i];
+                function_call_str += fmt.Sprintf("$%d::text::%s", i+1, function_parameters[i]);
+                function_args[i] = args[i]
                 if i < len(function_parameters) -1 {
                     function_call_str += ","
                 }
@@ -208,10 +167,10 @@ func resource(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
             var resourceFunctionQ string
             if (returns_record) {
                 resourceFunctionQ = fmt.Sprintf("select content, headers from %v as (content text, headers jsonb)", function_call_str);
-                err = dbpool.QueryRow(context.Background(), resourceFunctionQ).Scan(&content, &headers)
+                err = tx.QueryRow(ctx, resourceFunctionQ, function_args...).Scan(&content, &headers)
             } else {
                 resourceFunctionQ = fmt.Sprintf("select %v as content", function_call_str);
-                err = dbpool.QueryRow(context.Background(), resourceFunctionQ).Scan(&content)
+                err = tx.QueryRow(ctx, resourceFunctionQ, function_args...).Scan(&content)
             }
 
             if err != nil {
@@ -235,30 +194,177 @@ func resource(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Reques
               io.WriteString(w, content)
             }
 
-        /*
-        failed attempt at using pl/go solution
-        case "template":
+        case "template_route":
+            // url_args are the url_pattern's captures (or the whole match, if
+            // it has none), like the uwsgi endpoint's page.py passed
             const templateQ = `
                 select
                     endpoint.template_render(
-                        tkid::text, -- FIXME
-                        r.args::json::text, -- FIXME
-                        (array_to_json( regexp_matches(%v, r.url_pattern) ))::text -- FIXME
+                        t.id,
+                        r.args::json,
+                        coalesce((select array_to_json(m) from regexp_matches($2, r.url_pattern) m limit 1), '[]')
                     ) as content,
                     m.mimetype
                 from endpoint.template_route r
                     join endpoint.template t on r.template_id = t.id
-                    join endpoint.mimetype m on t.mimetype_id = m.id`
+                    join endpoint.mimetype m on t.mimetype_id = m.id
+                where r.id = $1`
 
-            err := dbpool.QueryRow(context.Background(), fmt.Sprintf(templateQ, pq.QuoteLiteral(path))).Scan(&content, &mimetype)
+            err := tx.QueryRow(ctx, templateQ, id, path).Scan(&content, &mimetype)
             if err != nil {
+                var pgErr *pgconn.PgError
+                if errors.As(err, &pgErr) && pgErr.Code == "42883" && strings.Contains(pgErr.Message, "endpoint.template_render(") {
+                    log.Print("Unable to render template: endpoint.template_render(uuid, json, json) does not exist.  Run `aquameta upgrade` to install it.")
+                    http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+                    return
+                }
                 log.Printf("QueryRow failed: %v", err)
+                http.Error(w, http.StatusText(httpStatus(err)), httpStatus(err))
+                return
             }
             w.Header().Set("Content-Type", mimetype)
             w.WriteHeader(200)
             io.WriteString(w, content)
-        */
         }
     }
     return resourceHandler
 }
+
+// matchRoutes matches path against endpoint.resource, endpoint.resource_binary,
+// endpoint.resource_function and endpoint.template_route in the database, for
+// when the route table isn't usable.
+func matchRoutes(ctx context.Context, tx pgx.Tx, path string) ([]route, error) {
+    const matchCountQ = `
+        select r.id::text, 'resource' as resource_table
+        from endpoint.resource r
+        where path = $1
+        and active = true
+
+        union
+
+        select r.id::text, 'resource_binary'
+        from endpoint.resource_binary r
+        where path = $1
+        and active = true
+
+        union
+
+        select r.id::text, 'resource_function'
+        from endpoint.resource_function r
+        -- 1. rewrite path_pattern to a regex:
+        --     /blog/{$1}/article/{$2} goes to ^/blog/([^\/\s]+)/article/([^\/\s]+)$
+        -- 2. match against the request path
+        where $1 ~ regexp_replace('^' || r.path_pattern || '$', '\${\d+}', '([^\/\s]+)', 'g')
+
+        union
+
+        select r.id::text, 'template_route'
+        from endpoint.template_route r
+        where $1 ~ r.url_pattern`
+
+    rows, err := tx.Query(ctx, matchCountQ, path)
+    if err != nil {
+        return nil, err
+    }
+    // the transaction's connection is busy until the rows are closed
+    defer rows.Close()
+
+    var routes []route
+    for rows.Next() {
+        var r route
+        if err := rows.Scan(&r.id, &r.table); err != nil {
+            return nil, err
+        }
+        routes = append(routes, r)
+    }
+    return routes, rows.Err()
+}
+
+// the Cache-Control sent for a resource without a cache_control of its own:
+// cache it, but check its ETag every time
+const defaultCacheControl = "no-cache"
+
+// serveResource serves a row of endpoint.resource or endpoint.resource_binary,
+// with an ETag of its id and row version, its modified column as its
+// Last-Modified, and its cache_control.  http.ServeContent
+// answers conditional and Range requests.  The content is only read if the response needs it, so
+// a 304 never reads it, and binary content is streamed a chunk at a time.
+// Text content is sent compressed if the client accepts it, from the
+// precompressed cache, with an ETag of its own.
+//
+// tx is committed before any content is sent: a slow client would otherwise
+// hold its connection, and an open transaction, for as long as it takes.  The
+// content is read as role in transactions of its own, each of which checks the
+// row is still the version the ETag names.
+func serveResource(ctx context.Context, w http.ResponseWriter, req *http.Request, dbpool *pgxpool.Pool, role string, tx pgx.Tx, table string, id string, compression *compressor) {
+    relation := pgx.Identifier{"endpoint", table}.Sanitize()
+
+    // xmin changes whenever the row does, and unlike md5(content) reading it
+    // doesn't read the content
+    var xmin, cacheControl, mimetype string
+    var size int64
+    var modified time.Time
+    err := tx.QueryRow(ctx, `
+        select r.xmin::text, octet_length(r.content), coalesce(r.cache_control, ''), m.mimetype, r.modified
+        from `+relation+` r
+            join endpoint.mimetype m on r.mimetype_id = m.id
+        where r.id = $1`, id).Scan(&xmin, &size, &cacheControl, &mimetype, &modified)
+    if err != nil {
+        log.Printf("QueryRow failed: %v", err)
+        http.Error(w, http.StatusText(httpStatus(err)), httpStatus(err))
+        return
+    }
+    if err := tx.Commit(ctx); err != nil {
+        log.Printf("Unable to commit request transaction: %v", err)
+        http.Error(w, http.StatusText(httpStatus(err)), httpStatus(err))
+        return
+    }
+    if cacheControl == "" {
+        cacheControl = defaultCacheControl
+    }
+
+    // the content is read from the row version the ETag names, or not at all
+    etag := id + "-" + xmin
+    var content io.ReadSeeker
+    if table == "resource_binary" {
+        chunkQ := "select substring(r.content from $3 for $4) from " + relation + " r where r.id = $1 and r.xmin::text = $2"
+        content = &byteaReader{
+            read: func(offset int64, length int) ([]byte, error) {
+                var chunk []byte
+                err := queryRowAs(ctx, dbpool, role, chunkQ, []interface{}{id, xmin, offset + 1, length}, &chunk)
+                return chunk, err
+            },
+            size: size,
+        }
+    } else {
+        load := func() ([]byte, error) {
+            var content []byte
+            err := queryRowAs(ctx, dbpool, role, "select r.content from "+relation+" r where r.id = $1 and r.xmin::text = $2", []interface{}{id, xmin}, &content)
+            if err == pgx.ErrNoRows {
+                err = errContentChanged
+            }
+            if err != nil {
+                log.Printf("Unable to read %s %s: %v", table, id, err)
+            }
+            return content, err
+        }
+
+        if compression.compressible(mimetype) {
+            w.Header().Add("Vary", "Accept-Encoding")
+        }
+        if encoding := compression.negotiate(req, mimetype); encoding != "" && size >= int64(compression.minSize) {
+            etag += "-" + encoding
+            w.Header().Set("Content-Encoding", encoding)
+            content = &lazyContent{load: func() ([]byte, error) {
+                return compression.precompressed(id+"-"+xmin, encoding, load)
+            }}
+        } else {
+            content = &lazyContent{load: load}
+        }
+    }
+
+    w.Header().Set("Content-Type", mimetype)
+    w.Header().Set("ETag", `"`+etag+`"`)
+    w.Header().Set("Cache-Control", cacheControl)
+    http.ServeContent(w, req, "", modified, content)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+    "context"
+    "github.com/jackc/pgx/v4/pgxpool"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "testing"
+)
+
+// testDatabase connects to the installed Aquameta database
+// AQUAMETA_TEST_DATABASE_URL names, as a role that can write endpoint's
+// tables, or skips the test.
+func testDatabase(t *testing.T) *pgxpool.Pool {
+    url := os.Getenv("AQUAMETA_TEST_DATABASE_URL")
+    if url == "" {
+        t.Skip("AQUAMETA_TEST_DATABASE_URL is not set")
+    }
+    dbpool, err := pgxpool.Connect(context.Background(), url)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(dbpool.Close)
+    return dbpool
+}
+
+func TestResourceAnonymous(t *testing.T) {
+    dbpool := testDatabase(t)
+    ctx := context.Background()
+
+    const path = "/aquameta-test-anonymous"
+    _, err := dbpool.Exec(ctx, `
+        insert into endpoint.resource (path, mimetype_id, content)
+        values ($1, (select id from endpoint.mimetype where mimetype = 'text/html'), 'public')`, path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        dbpool.Exec(ctx, "delete from endpoint.resource where path = $1", path)
+    })
+
+    // no SESSION cookie, so it runs as anonymous
+    w := httptest.NewRecorder()
+    resource(dbpool, nil, newCompressor(Compression{Disabled: true}))(w, httptest.NewRequest("GET", path, nil))
+
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d, want 200: %s", w.Code, w.Body.String())
+    }
+    if contentType := w.Header().Get("Content-Type"); contentType != "text/html" {
+        t.Errorf("Content-Type %q, want text/html", contentType)
+    }
+    if body := w.Body.String(); body != "public" {
+        t.Errorf("body %q, want \"public\"", body)
+    }
+}
+
+func TestResourceLastModified(t *testing.T) {
+    dbpool := testDatabase(t)
+    ctx := context.Background()
+
+    const path = "/aquameta-test-last-modified"
+    const lastModified = "Thu, 04 Mar 2021 05:06:07 GMT"
+    _, err := dbpool.Exec(ctx, `
+        insert into endpoint.resource (path, mimetype_id, content, modified)
+        values ($1, (select id from endpoint.mimetype where mimetype = 'text/html'), 'before', '2021-03-04 05:06:07+00')`, path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        dbpool.Exec(ctx, "delete from endpoint.resource where path = $1", path)
+    })
+
+    get := func(ifModifiedSince string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("GET", path, nil)
+        if ifModifiedSince != "" {
+            req.Header.Set("If-Modified-Since", ifModifiedSince)
+        }
+        w := httptest.NewRecorder()
+        resource(dbpool, nil, newCompressor(Compression{Disabled: true}))(w, req)
+        return w
+    }
+
+    w := get("")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d, want 200: %s", w.Code, w.Body.String())
+    }
+    if got := w.Header().Get("Last-Modified"); got != lastModified {
+        t.Errorf("Last-Modified %q, want %q", got, lastModified)
+    }
+    if w := get(lastModified); w.Code != http.StatusNotModified {
+        t.Errorf("If-Modified-Since its Last-Modified: status %d, want 304", w.Code)
+    }
+
+    // the trigger moves modified on update
+    if _, err := dbpool.Exec(ctx, "update endpoint.resource set content = 'after' where path = $1", path); err != nil {
+        t.Fatal(err)
+    }
+    w = get(lastModified)
+    if w.Code != http.StatusOK || w.Body.String() != "after" {
+        t.Errorf("after update: status %d, body %q, want 200 \"after\"", w.Code, w.Body.String())
+    }
+}
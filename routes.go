@@ -0,0 +1,265 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "github.com/jackc/pgx/v4"
+    "github.com/jackc/pgx/v4/pgxpool"
+    "log"
+    "regexp"
+    "sync"
+    "time"
+)
+
+// the channel endpoint.notify_route_change() notifies when the resource tables
+// change
+const routesChannel = "endpoint_routes"
+
+// how long to wait before listening again after losing the connection
+const routesRetryInterval = 5 * time.Second
+
+// a bundle checkout changes the resource tables one statement at a time, so
+// the table is reloaded once the notifications have been quiet this long
+const routesSettleTime = 100 * time.Millisecond
+
+// the database was installed before endpoint.notify_route_change() existed
+var errNoRouteTriggers = errors.New("endpoint.notify_route_change() does not exist")
+
+// ${n} in a path_pattern, which matches one path segment
+var pathPatternArg = regexp.MustCompile(`\$\{\d+\}`)
+
+// route is a row of endpoint.resource, endpoint.resource_binary,
+// endpoint.resource_function or endpoint.template_route a request path can
+// match.
+type route struct {
+    id string
+    table string
+}
+
+type patternRoute struct {
+    route
+    pattern *regexp.Regexp
+}
+
+// routeTable holds every active path, path_pattern and url_pattern in memory,
+// so resource() only goes to the database for the content.  It is only usable
+// while it is listening for changes; before that, after it loses its
+// connection, or if a pattern won't compile, resource() matches in the
+// database instead.
+type routeTable struct {
+    mu sync.RWMutex
+    usable bool
+    exact map[string][]route
+    patterns []patternRoute
+
+    cancel context.CancelFunc
+    done chan bool
+}
+
+// watchRoutes loads the route table and keeps it fresh, on a connection from
+// pool that it holds until close().
+func watchRoutes(pool *pgxpool.Pool) *routeTable {
+    ctx, cancel := context.WithCancel(context.Background())
+    t := &routeTable{cancel: cancel, done: make(chan bool)}
+
+    go func() {
+        defer close(t.done)
+        for {
+            err := t.listen(ctx, pool)
+            t.invalidate()
+            if ctx.Err() != nil {
+                return
+            }
+            if err == errNoRouteTriggers {
+                log.Printf("Route table disabled, %v; matching routes in the database.  Run `aquameta upgrade` to enable it.", err)
+                return
+            }
+            log.Printf("Route table lost its connection, matching routes in the database until it's back: %v", err)
+            select {
+            case <-time.After(routesRetryInterval):
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+
+    return t
+}
+
+// listen loads the table, then reloads it on every change until the
+// connection fails or ctx is cancelled.
+func (t *routeTable) listen(ctx context.Context, pool *pgxpool.Pool) error {
+    cn, err := pool.Acquire(ctx)
+    if err != nil {
+        return err
+    }
+    defer cn.Release()
+
+    var triggers bool
+    err = cn.QueryRow(ctx, "select to_regproc('endpoint.notify_route_change') is not null").Scan(&triggers)
+    if err != nil {
+        return err
+    }
+    if !triggers {
+        return errNoRouteTriggers
+    }
+
+    // listen first, so no change slips in before the load
+    if _, err := cn.Exec(ctx, "listen "+routesChannel); err != nil {
+        return err
+    }
+    if err := t.load(ctx, cn.Conn()); err != nil {
+        return err
+    }
+
+    for {
+        notification, err := cn.Conn().WaitForNotification(ctx)
+        if err != nil {
+            return err
+        }
+        log.Printf("Routes changed in endpoint.%s", notification.Payload)
+
+        for {
+            settle, cancel := context.WithTimeout(ctx, routesSettleTime)
+            _, err := cn.Conn().WaitForNotification(settle)
+            cancel()
+            if ctx.Err() != nil {
+                return ctx.Err()
+            }
+            if errors.Is(err, context.DeadlineExceeded) {
+                break
+            }
+            if err != nil {
+                return err
+            }
+        }
+
+        if err := t.load(ctx, cn.Conn()); err != nil {
+            return err
+        }
+    }
+}
+
+// load reads every route from the database.  A path_pattern Go can't compile
+// leaves the table unusable until the next change, rather than failing.
+func (t *routeTable) load(ctx context.Context, conn *pgx.Conn) error {
+    const routesQ = `
+        select r.id::text, 'resource', r.path
+        from endpoint.resource r
+        where r.active = true
+
+        union all
+
+        select r.id::text, 'resource_binary', r.path
+        from endpoint.resource_binary r
+        where r.active = true
+
+        union all
+
+        select r.id::text, 'resource_function', r.path_pattern
+        from endpoint.resource_function r
+
+        union all
+
+        select r.id::text, 'template_route', r.url_pattern
+        from endpoint.template_route r`
+
+    rows, err := conn.Query(ctx, routesQ)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    exact := make(map[string][]route)
+    var patterns []patternRoute
+    usable := true
+    for rows.Next() {
+        var r route
+        var path string
+        if err := rows.Scan(&r.id, &r.table, &path); err != nil {
+            return err
+        }
+        var pattern *regexp.Regexp
+        switch r.table {
+        case "resource_function":
+            pattern, err = compilePathPattern(path)
+        case "template_route":
+            // matched anywhere in the path, like regexp_matches()
+            pattern, err = regexp.Compile(path)
+        default:
+            exact[path] = append(exact[path], r)
+            continue
+        }
+        if err != nil {
+            log.Printf("Route table disabled until the next change, matching routes in the database: endpoint.%s %s: %v", r.table, r.id, err)
+            usable = false
+            continue
+        }
+        patterns = append(patterns, patternRoute{r, pattern})
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    t.mu.Lock()
+    t.usable, t.exact, t.patterns = usable, exact, patterns
+    t.mu.Unlock()
+    log.Printf("Route table loaded: %d paths, %d patterns", len(exact), len(patterns))
+    return nil
+}
+
+// compilePathPattern does in Go what resource()'s query did in SQL: a
+// path_pattern is a regular expression for the whole path, in which each
+// ${n} matches a path segment.
+func compilePathPattern(pathPattern string) (*regexp.Regexp, error) {
+    return regexp.Compile(pathPatternArg.ReplaceAllLiteralString("^"+pathPattern+"$", `([^/\s]+)`))
+}
+
+// invalidate makes resource() match in the database until the next load.
+func (t *routeTable) invalidate() {
+    t.mu.Lock()
+    t.usable = false
+    t.mu.Unlock()
+}
+
+// lookup returns the routes path matches, or false if the table isn't usable
+// right now.
+func (t *routeTable) lookup(path string) ([]route, bool) {
+    if t == nil {
+        return nil, false
+    }
+    t.mu.RLock()
+    defer t.mu.RUnlock()
+    if !t.usable {
+        return nil, false
+    }
+
+    matches := append([]route(nil), t.exact[path]...)
+    for _, p := range t.patterns {
+        if p.pattern.MatchString(path) {
+            matches = append(matches, p.route)
+        }
+    }
+    return matches, true
+}
+
+// stats returns how many paths and patterns the table holds, and whether
+// it's usable.
+func (t *routeTable) stats() (paths int, patterns int, usable bool) {
+    if t == nil {
+        return 0, 0, false
+    }
+    t.mu.RLock()
+    defer t.mu.RUnlock()
+    return len(t.exact), len(t.patterns), t.usable
+}
+
+// close stops watching and releases the connection.
+func (t *routeTable) close(ctx context.Context) {
+    t.cancel()
+    select {
+    case <-t.done:
+    case <-ctx.Done():
+        log.Println("Route table LISTEN connection did not stop in time")
+    }
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "reflect"
+    "regexp"
+    "testing"
+)
+
+func TestCompilePathPattern(t *testing.T) {
+    tests := []struct {
+        pattern string
+        path string
+        match bool
+        args []string
+    }{
+        {"/user/${1}", "/user/42", true, []string{"42"}},
+        {"/user/${1}", "/user/42/", false, nil},
+        {"/user/${1}", "/user/", false, nil},
+        {"/user/${1}", "/api/user/42", false, nil},
+        {"/user/${1}", "/user/a b", false, nil},
+        {"/${1}/${2}.json", "/widget/7.json", true, []string{"widget", "7"}},
+        {"/${1}/${2}.json", "/widget/x/7.json", false, nil},
+        {"/static/.*", "/static/css/site.css", true, []string{}},
+        {"/about", "/about", true, []string{}},
+    }
+    for _, test := range tests {
+        pattern, err := compilePathPattern(test.pattern)
+        if err != nil {
+            t.Errorf("compilePathPattern(%q): %v", test.pattern, err)
+            continue
+        }
+        match := pattern.FindStringSubmatch(test.path)
+        if (match != nil) != test.match {
+            t.Errorf("%q matches %q: %v, want %v", test.pattern, test.path, match != nil, test.match)
+            continue
+        }
+        if match != nil && !reflect.DeepEqual(match[1:], test.args) {
+            t.Errorf("%q on %q captured %q, want %q", test.pattern, test.path, match[1:], test.args)
+        }
+    }
+
+    // what PostgreSQL's regexp accepts and RE2 doesn't disables the table
+    if _, err := compilePathPattern(`/(?=user)${1}`); err == nil {
+        t.Error("compilePathPattern compiled a lookahead")
+    }
+}
+
+func TestRouteTableLookup(t *testing.T) {
+    resource := route{"1", "resource"}
+    binary := route{"2", "resource_binary"}
+    function := route{"3", "resource_function"}
+    template := route{"4", "template_route"}
+
+    table := &routeTable{
+        usable: true,
+        exact: map[string][]route{
+            "/": {resource},
+            "/logo.png": {binary},
+            "/user/me": {resource},
+        },
+        patterns: []patternRoute{
+            {function, regexp.MustCompile(`^/user/([^/\s]+)$`)},
+            {template, regexp.MustCompile(`/doc/`)},
+        },
+    }
+
+    tests := []struct {
+        name string
+        table *routeTable
+        path string
+        routes []route
+        ok bool
+    }{
+        {"nil table", nil, "/", nil, false},
+        {"unusable table", &routeTable{exact: table.exact}, "/", nil, false},
+        {"exact", table, "/logo.png", []route{binary}, true},
+        {"exact and pattern", table, "/user/me", []route{resource, function}, true},
+        {"pattern", table, "/user/42", []route{function}, true},
+        {"matched anywhere", table, "/en/doc/intro", []route{template}, true},
+        {"no route", table, "/missing", nil, true},
+    }
+    for _, test := range tests {
+        routes, ok := test.table.lookup(test.path)
+        if ok != test.ok {
+            t.Errorf("%s: lookup(%q) usable %v, want %v", test.name, test.path, ok, test.ok)
+        }
+        if len(routes) != 0 || len(test.routes) != 0 {
+            if !reflect.DeepEqual(routes, test.routes) {
+                t.Errorf("%s: lookup(%q) = %v, want %v", test.name, test.path, routes, test.routes)
+            }
+        }
+    }
+
+    // lookup copies, so changing what it returns leaves the table alone
+    routes, _ := table.lookup("/")
+    routes[0] = binary
+    if again, _ := table.lookup("/"); again[0] != resource {
+        t.Error("lookup returned the table's own slice")
+    }
+}
+
+func TestRouteTableStats(t *testing.T) {
+    var table *routeTable
+    if paths, patterns, usable := table.stats(); paths != 0 || patterns != 0 || usable {
+        t.Errorf("nil table stats %d, %d, %v", paths, patterns, usable)
+    }
+
+    table = &routeTable{
+        usable: true,
+        exact: map[string][]route{"/": {{"1", "resource"}}},
+        patterns: []patternRoute{{route{"2", "template_route"}, regexp.MustCompile(`x`)}},
+    }
+    table.invalidate()
+    if paths, patterns, usable := table.stats(); paths != 1 || patterns != 1 || usable {
+        t.Errorf("invalidated table stats %d, %d, %v", paths, patterns, usable)
+    }
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "context"
+    "github.com/jackc/pgx/v4"
+    "github.com/jackc/pgx/v4/pgxpool"
+    "log"
+    "net/http"
+)
+
+// the cookie holding the endpoint.session id, same as the uwsgi AuthMiddleware
+const sessionCookie = "SESSION"
+
+// the role requests run as without a valid session
+const anonymousRole = "anonymous"
+
+// sessionRole resolves the request's SESSION cookie through endpoint.session()
+// to the role the request should run as, falling back to anonymous.
+func sessionRole(ctx context.Context, dbpool *pgxpool.Pool, req *http.Request) string {
+    cookie, err := req.Cookie(sessionCookie)
+    if err != nil || cookie.Value == "" {
+        return anonymousRole
+    }
+
+    var role string
+    err = dbpool.QueryRow(ctx, "select (role_id).name from endpoint.session($1::uuid)", cookie.Value).Scan(&role)
+    if err != nil {
+        // unknown or malformed session id
+        if err != pgx.ErrNoRows {
+            log.Printf("Session lookup failed: %v", err)
+        }
+        return anonymousRole
+    }
+    return role
+}
+
+// beginAs starts the request's transaction, switched to role with `set local
+// role` so it reverts when the transaction ends and the connection goes back
+// to the pool.
+func beginAs(ctx context.Context, dbpool *pgxpool.Pool, role string) (pgx.Tx, error) {
+    tx, err := dbpool.Begin(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := tx.Exec(ctx, "set local role "+pgx.Identifier{role}.Sanitize()); err != nil {
+        tx.Rollback(ctx)
+        return nil, err
+    }
+    return tx, nil
+}
+
+// login handles POST /login with email and password form fields, setting the
+// SESSION cookie from endpoint.login() and redirecting to ?redirectURL= (or /).
+// Everything else under /login, e.g. GET for the login page, goes to next.
+func login(dbpool *pgxpool.Pool, next http.HandlerFunc) func(w http.ResponseWriter, req *http.Request) {
+    loginHandler := func(w http.ResponseWriter, req *http.Request) {
+        if req.Method != http.MethodPost {
+            next(w, req)
+            return
+        }
+        log.Println(req.Proto, req.Method, req.RequestURI)
+
+        email, password := req.PostFormValue("email"), req.PostFormValue("password")
+        if email == "" || password == "" {
+            http.Error(w, "email and password are required", http.StatusBadRequest)
+            return
+        }
+
+        // endpoint.login() raises on an unknown email, and returns null on a wrong password
+        var sessionId *string
+        err := dbpool.QueryRow(req.Context(), "select endpoint.login($1, $2)::text", email, password).Scan(&sessionId)
+        if err != nil || sessionId == nil {
+            if err != nil {
+                log.Printf("Login failed: %v", err)
+            }
+            http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+            return
+        }
+
+        http.SetCookie(w, &http.Cookie{
+            Name: sessionCookie,
+            Value: *sessionId,
+            Path: "/",
+            HttpOnly: true,
+            Secure: req.TLS != nil,
+            SameSite: http.SameSiteLaxMode,
+        })
+        http.Redirect(w, req, redirectURL(req), http.StatusSeeOther)
+    }
+    return loginHandler
+}
+
+// logout ends the session's user's sessions through endpoint.logout(), clears
+// the SESSION cookie and redirects to ?redirectURL= (or /).
+func logout(dbpool *pgxpool.Pool) func(w http.ResponseWriter, req *http.Request) {
+    logoutHandler := func(w http.ResponseWriter, req *http.Request) {
+        log.Println(req.Proto, req.Method, req.RequestURI)
+
+        if cookie, err := req.Cookie(sessionCookie); err == nil {
+            var email string
+            err := dbpool.QueryRow(req.Context(), `
+                select u.email
+                from endpoint.session($1::uuid) s
+                    join endpoint.user u on u.id = s.user_id`,
+                cookie.Value).Scan(&email)
+            if err == nil {
+                _, err = dbpool.Exec(req.Context(), "select endpoint.logout($1)", email)
+            }
+            if err != nil && err != pgx.ErrNoRows {
+                log.Printf("Logout failed: %v", err)
+            }
+        }
+
+        http.SetCookie(w, &http.Cookie{
+            Name: sessionCookie,
+            Value: "",
+            Path: "/",
+            MaxAge: -1,
+            HttpOnly: true,
+            Secure: req.TLS != nil,
+            SameSite: http.SameSiteLaxMode,
+        })
+        http.Redirect(w, req, redirectURL(req), http.StatusSeeOther)
+    }
+    return logoutHandler
+}
+
+// redirectURL returns the local path to redirect to after login or logout.
+func redirectURL(req *http.Request) string {
+    url := req.URL.Query().Get("redirectURL")
+    // only local paths, no open redirects
+    if len(url) == 0 || url[0] != '/' || (len(url) > 1 && (url[1] == '/' || url[1] == '\\')) {
+        return "/"
+    }
+    return url
+}
+
+// queryRowAs runs a single row query as role in a transaction of its own, for
+// reads that mustn't hold a connection while a response is being written.
+func queryRowAs(ctx context.Context, dbpool *pgxpool.Pool, role string, query string, args []interface{}, dest ...interface{}) error {
+    tx, err := beginAs(ctx, dbpool, role)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+    if err := tx.QueryRow(ctx, query, args...).Scan(dest...); err != nil {
+        return err
+    }
+    return tx.Commit(ctx)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+    "net/http/httptest"
+    "net/url"
+    "testing"
+)
+
+func TestRedirectURL(t *testing.T) {
+    tests := []struct {
+        redirectURL string
+        want string
+    }{
+        {"", "/"},
+        {"/", "/"},
+        {"/dev/ide", "/dev/ide"},
+        {"/search?q=a&page=2", "/search?q=a&page=2"},
+        {"//evil.example.com/", "/"},
+        {`/\evil.example.com/`, "/"},
+        {"https://evil.example.com/", "/"},
+        {"javascript:alert(1)", "/"},
+        {"dev/ide", "/"},
+    }
+    for _, test := range tests {
+        req := httptest.NewRequest("POST", "/endpoint/login?redirectURL="+url.QueryEscape(test.redirectURL), nil)
+        if got := redirectURL(req); got != test.want {
+            t.Errorf("redirectURL(%q) = %q, want %q", test.redirectURL, got, test.want)
+        }
+    }
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "github.com/jackc/pgx/v4/pgxpool"
+    "github.com/lib/pq"
+    "log"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// outdatedExtension is an installed extension whose version differs from the
+// one this server was built for.
+type outdatedExtension struct {
+    extension
+    InstalledVersion string
+    UpdatePath string    // e.g. "0.4.0--0.4.1--0.5.0", empty if PostgreSQL knows no path
+}
+
+// outdatedExtensions lists the installed Aquameta extensions that need an
+// `alter extension ... update`, along with the chain of upgrade scripts
+// PostgreSQL would run.
+func outdatedExtensions(dbpool *pgxpool.Pool) ([]outdatedExtension, error) {
+    var outdated []outdatedExtension
+
+    for _, ext := range extensions {
+        if ext.Version == "" {
+            continue
+        }
+
+        var installedVersion string
+        err := dbpool.QueryRow(context.Background(),
+            "select coalesce((select extversion from pg_catalog.pg_extension where extname = $1), '')",
+            ext.Name).Scan(&installedVersion)
+        if err != nil {
+            return nil, fmt.Errorf("unable to check extension %s: %v", ext.Name, err)
+        }
+        if installedVersion == "" || installedVersion == ext.Version {
+            continue
+        }
+
+        // pg_extension_update_paths() errors if the control file is gone, so
+        // only ask when the extension is still available
+        var updatePath string
+        err = dbpool.QueryRow(context.Background(), `
+            select coalesce((
+                select p.path
+                from pg_catalog.pg_available_extensions a,
+                    pg_catalog.pg_extension_update_paths(a.name) p
+                where a.name = $1 and p.source = $2 and p.target = $3
+            ), '')`,
+            ext.Name, installedVersion, ext.Version).Scan(&updatePath)
+        if err != nil {
+            return nil, fmt.Errorf("unable to find update path for extension %s: %v", ext.Name, err)
+        }
+
+        outdated = append(outdated, outdatedExtension{ext, installedVersion, updatePath})
+    }
+    return outdated, nil
+}
+
+// upgradeAquameta updates each outdated extension along its chain of upgrade
+// scripts, then re-imports (and checks out) each configured bundle whose head
+// commit in the bundle sources is newer than the one in the database.  Bundles that have local
+// commits the bundle file doesn't know about are left alone.
+func upgradeAquameta(config tomlConfig, dbpool *pgxpool.Pool, workingDirectory string, dryRun bool) (installReport, error) {
+    var report installReport
+    ctx := context.Background()
+
+    // newer upgrade scripts have to be in PostgreSQL's extension directory
+    // before it can find a path to them
+    if config.Database.Mode == "embedded" && !dryRun {
+        if err := copyExtensionFiles(workingDirectory, config.Database.EmbeddedPostgresRuntimePath); err != nil {
+            return report, fmt.Errorf("unable to copy extension files: %v", err)
+        }
+    }
+
+    //
+    // extensions
+    //
+    outdated, err := outdatedExtensions(dbpool)
+    if err != nil {
+        return report, err
+    }
+
+    for _, ext := range outdated {
+        item := "extension " + ext.Name
+
+        if ext.UpdatePath == "" {
+            return report, fmt.Errorf("no upgrade path for %s from %s to %s; expected an upgrade script like extensions/*/%s--%s--%s.sql",
+                item, ext.InstalledVersion, ext.Version, ext.Name, ext.InstalledVersion, ext.Version)
+        }
+
+        if !dryRun {
+            q := "alter extension " + pq.QuoteIdentifier(ext.Name) + " update to " + pq.QuoteLiteral(ext.Version)
+            log.Print(q)
+            if _, err := dbpool.Exec(ctx, q); err != nil {
+                return report, fmt.Errorf("unable to upgrade %s: %v", item, err)
+            }
+        }
+        report.add(dryRun, item, "upgraded", strings.ReplaceAll(ext.UpdatePath, "--", " -> "))
+    }
+
+    //
+    // core bundles
+    //
+    repositoryExists, err := relationExists(dbpool, "bundle.repository")
+    if err != nil {
+        return report, fmt.Errorf("unable to check for bundle.repository: %v", err)
+    }
+    if !repositoryExists {
+        return report, fmt.Errorf("bundle.repository does not exist, run `aquameta install` first")
+    }
+
+    sources := config.bundleSources(workingDirectory)
+
+    for _, configBundle := range config.bundles() {
+        bundleName := configBundle.Name
+        item := "bundle " + bundleName
+
+        content, location, err := readBundle(sources, bundleName)
+        if err != nil {
+            return report, err
+        }
+        bundle, err := parseBundleFile(content)
+        if err != nil {
+            return report, fmt.Errorf("unable to read %s: %v", location, err)
+        }
+
+        var headCommitID string
+        var checkedOut bool
+        err = dbpool.QueryRow(ctx, `
+            select coalesce(max(head_commit_id::text), ''), coalesce(bool_or(checkout_commit_id is not null), false)
+            from bundle.repository where name = $1`,
+            bundleName).Scan(&headCommitID, &checkedOut)
+        if err != nil {
+            return report, fmt.Errorf("unable to check %s: %v", item, err)
+        }
+
+        // not installed at all is the installer's job
+        if headCommitID == "" {
+            report.add(dryRun, item, "skipped", "not installed, run `aquameta install`")
+            continue
+        }
+        if headCommitID == bundle.Repository.HeadCommitID {
+            report.add(dryRun, item, "present", "")
+            continue
+        }
+
+        // only fast-forward: the database's head has to be in the file's history
+        known := false
+        for _, commit := range bundle.Commits {
+            if commit.ID == headCommitID {
+                known = true
+                break
+            }
+        }
+        if !known {
+            report.add(dryRun, item, "skipped", "database has commits not in "+location)
+            continue
+        }
+
+        // the checked out rows are replaced, along with any changes to them
+        var changed bool
+        err = dbpool.QueryRow(ctx,
+            "select bundle.bundle_has_uncommitted_changes(id) from bundle.repository where name = $1",
+            bundleName).Scan(&changed)
+        if err != nil {
+            return report, fmt.Errorf("unable to check %s for uncommitted changes: %v", item, err)
+        }
+        if changed {
+            report.add(dryRun, item, "skipped", "has uncommitted changes, commit or discard them first")
+            continue
+        }
+
+        if !dryRun {
+            log.Print("  - "+location)
+            tx, err := dbpool.Begin(ctx)
+            if err != nil {
+                return report, err
+            }
+            // what was checked out stays checked out
+            for _, stmt := range bundleUpgrade(bundleName, content, checkedOut || configBundle.checkout()) {
+                if _, err = tx.Exec(ctx, stmt.query, stmt.args...); err != nil {
+                    break
+                }
+            }
+            if err != nil {
+                tx.Rollback(ctx)
+                return report, fmt.Errorf("unable to upgrade %s: %v", item, err)
+            }
+            if err := tx.Commit(ctx); err != nil {
+                return report, fmt.Errorf("unable to upgrade %s: %v", item, err)
+            }
+        }
+        report.add(dryRun, item, "upgraded", shortCommitID(headCommitID)+" -> "+shortCommitID(bundle.Repository.HeadCommitID))
+    }
+
+    return report, nil
+}
+
+// statement is a query and its arguments.
+type statement struct {
+    query string
+    args []interface{}
+}
+
+// bundleUpgrade returns the statements that replace an installed bundle's
+// repository with content's, and check out its head if checkout is set.  The
+// old checkout's rows are deleted first, while its commit still says which
+// rows they are; once the repository is gone, rows the new head no longer has
+// would stay behind.
+func bundleUpgrade(name string, content []byte, checkout bool) []statement {
+    stmts := []statement{
+        {"select bundle.checkout_delete(id, checkout_commit_id) from bundle.repository where name = $1 and checkout_commit_id is not null", []interface{}{name}},
+        {"delete from bundle.repository where name = $1", []interface{}{name}},
+        {"select bundle.import_repository($1)", []interface{}{string(content)}},
+    }
+    if checkout {
+        stmts = append(stmts, statement{"select bundle.checkout($1)", []interface{}{name}})
+    }
+    return stmts
+}
+
+func shortCommitID(id string) string {
+    if len(id) > 8 {
+        return id[:8]
+    }
+    return id
+}
+
+// backupDatabase writes a pg_dump of the database to directory, using the
+// embedded server's pg_dump when there is one.  It returns the dump's path.
+func backupDatabase(config tomlConfig, directory string) (string, error) {
+    if err := os.MkdirAll(directory, 0700); err != nil {
+        return "", err
+    }
+
+    pgDump := "pg_dump"
+    if config.Database.Mode == "embedded" {
+        pgDump = filepath.Join(config.Database.EmbeddedPostgresRuntimePath, "bin", "pg_dump")
+    }
+
+    // the password goes in pg_dump's environment, which only this user can
+    // read, rather than on its command line, which everyone can
+    password := config.Database.Password
+    config.Database.Password = ""
+
+    file := filepath.Join(directory, fmt.Sprintf("%s-%s.dump", config.Database.DatabaseName, time.Now().Format("20060102-150405")))
+    cmd := exec.Command(pgDump, "--format=custom", "--file="+file, "--dbname="+connectionString(config))
+    if config.Database.auth() == "password" && password != "" {
+        cmd.Env = append(os.Environ(), "PGPASSWORD="+password)
+    }
+    if out, err := cmd.CombinedOutput(); err != nil {
+        return "", fmt.Errorf("%s failed: %v\n%s", pgDump, err, out)
+    }
+    return file, nil
+}
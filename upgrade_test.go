@@ -0,0 +1,30 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestBundleUpgrade(t *testing.T) {
+    tests := []struct {
+        checkout bool
+        want []string
+    }{
+        {true, []string{"bundle.checkout_delete(", "delete from bundle.repository", "bundle.import_repository(", "bundle.checkout("}},
+        {false, []string{"bundle.checkout_delete(", "delete from bundle.repository", "bundle.import_repository("}},
+    }
+    for _, test := range tests {
+        stmts := bundleUpgrade("org.aquameta.core.endpoint", []byte("{}"), test.checkout)
+        if len(stmts) != len(test.want) {
+            t.Errorf("checkout %v: %d statements, want %d", test.checkout, len(stmts), len(test.want))
+            continue
+        }
+        // the old checkout's rows have to go while its commit still lists
+        // them, or rows the new head dropped would be left behind
+        for i, want := range test.want {
+            if !strings.Contains(stmts[i].query, want) {
+                t.Errorf("checkout %v: statement %d is %q, want %s", test.checkout, i, stmts[i].query, want)
+            }
+        }
+    }
+}
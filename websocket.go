@@ -10,16 +10,53 @@ import (
     "log"
     "net/http"
     "strings"
+    "sync"
 )
 
 // ws handler
 var sockets = make(map[string]socketio.Conn)
-var listen = make(chan string)
-var unlisten = make(chan string)
+var socketsMu sync.Mutex
 
-func websocket(dbpool *pgxpool.Pool) *socketio.Server {
+// eventListener hands session ids to the LISTEN goroutine of one socket.io
+// server.  Each server gets its own, so nothing sent to one that has stopped
+// reaches the one a restart started.
+type eventListener struct {
+    listen chan string
+    unlisten chan string
+    stop chan bool      // closed to stop the goroutine
+    done chan bool      // closed once the goroutine has released its connection
+}
+
+// running reports whether the LISTEN goroutine is still running; it stops if
+// it loses its connection.
+func (l *eventListener) running() bool {
+    if l == nil {
+        return false
+    }
+    select {
+    case <-l.done:
+        return false
+    default:
+        return true
+    }
+}
+
+// send hands sessionId to the LISTEN goroutine on ch, or drops it if the
+// goroutine has stopped.
+func (l *eventListener) send(ch chan string, sessionId string) {
+    select {
+    case ch <- sessionId:
+    case <-l.done:
+        log.Println("wsServer listener has stopped, dropping", redactSessionID(sessionId))
+    }
+}
+
+func websocket(dbpool *pgxpool.Pool) (*socketio.Server, *eventListener) {
     wsServer := socketio.NewServer(nil)
 
+    listener := &eventListener{listen: make(chan string), unlisten: make(chan string), stop: make(chan bool), done: make(chan bool)}
+    listen, unlisten := listener.listen, listener.unlisten
+
     wsServer.OnConnect("/", func(s socketio.Conn) error {
         log.Println("wsServer connected", s.ID())
         return nil
@@ -30,18 +67,30 @@ func websocket(dbpool *pgxpool.Pool) *socketio.Server {
             log.Println("wsServer attach received `null` as sessionId")
             return "err"
         }
-        log.Println("wsServer attaching", sessionId)
+        log.Println("wsServer attaching", redactSessionID(sessionId))
         s.Emit("event", fmt.Sprintf("{\"type\": \"attached\", \"sessionId\": \"%s\"}", sessionId))
+        socketsMu.Lock()
         sockets[sessionId] = s
-        listen <- sessionId
+        socketsMu.Unlock()
+        listener.send(listen, sessionId)
         return "ok"
     })
 
-    sendEvent := func(s socketio.Conn, event string) {
+    // the session may have detached since the event was raised
+    sendEvent := func(sessionId string, event string) {
+        socketsMu.Lock()
+        s := sockets[sessionId]
+        socketsMu.Unlock()
+        if s == nil {
+            log.Printf("wsServer dropping event for detached session %s", redactSessionID(sessionId))
+            return
+        }
         s.Emit("event", fmt.Sprintf("{\"type\": \"event\", \"data\": %s}", string(event)))
     }
 
     go func(pool *pgxpool.Pool) {
+        defer close(listener.done)
+
         //  Need to acquire a connection that will LISTEN on this sessionId
         cn, err := pool.Acquire(context.Background())
         if err != nil {
@@ -64,9 +113,8 @@ func websocket(dbpool *pgxpool.Pool) *socketio.Server {
                     log.Println("wsServer notification error: ", er)
                     break
                 } else {
-                    log.Printf("wsServer notification %#v\n", notification.Channel)
-                    sessionId := notification.Channel
-                    sendEvent(sockets[sessionId], string(notification.Payload))
+                    log.Printf("wsServer notification %#v\n", redactSessionID(notification.Channel))
+                    sendEvent(notification.Channel, string(notification.Payload))
                 }
             }
             close(done)
@@ -74,6 +122,14 @@ func websocket(dbpool *pgxpool.Pool) *socketio.Server {
 
         for {
             select {
+            case <-listener.stop:
+                if cancel != nil {
+                    cancel()
+                    // wait until done cancelling
+                    <-done
+                }
+                return
+
             case sessionId := <-listen:
                 if cancel != nil {
                     cancel()
@@ -83,7 +139,8 @@ func websocket(dbpool *pgxpool.Pool) *socketio.Server {
                 }
 
                 // listen
-                _, err = cn.Exec(context.Background(), fmt.Sprintf("listen \"%s\"", sessionId))
+                // LISTEN can't take a bind parameter, so quote the channel name
+                _, err = cn.Exec(context.Background(), "listen "+pgx.Identifier{sessionId}.Sanitize())
                 if err != nil {
                     log.Println("wsServer error calling listen: ", err)
                     return
@@ -95,18 +152,19 @@ func websocket(dbpool *pgxpool.Pool) *socketio.Server {
                 // select from event.event and publish those
                 rows, err := pool.Query(context.Background(), "select event from event.event where session_id=$1;", sessionId)
                 if err != nil {
-                    fmt.Println("wsServer error reading queued events:", err)
+                    log.Println("wsServer error reading queued events:", err)
+                    continue
                 }
                 for rows.Next() {
                     var event string
                     err := rows.Scan(&event)
                     if err != nil {
-                        fmt.Println("wsServer error scanning queued event:", err)
+                        log.Println("wsServer error scanning queued event:", err)
                         continue
                     }
                     log.Printf("wsServer event.event: %#v\n", event)
 
-                    sendEvent(sockets[sessionId], event)
+                    sendEvent(sessionId, event)
                 }
                 rows.Close()
 
@@ -119,7 +177,7 @@ func websocket(dbpool *pgxpool.Pool) *socketio.Server {
                 }
 
                 // unlisten
-                _, err = cn.Exec(context.Background(), fmt.Sprintf("unlisten \"%s\"", sessionId))
+                _, err = cn.Exec(context.Background(), "unlisten "+pgx.Identifier{sessionId}.Sanitize())
                 if err != nil {
                     log.Println("wsServer error calling unlisten: ", err)
                 }
@@ -129,7 +187,7 @@ func websocket(dbpool *pgxpool.Pool) *socketio.Server {
 
                 _, err := pool.Exec(context.Background(), "delete from event.session where id=$1;", sessionId)
                 if err != nil {
-                    fmt.Println("wsServer error deleting old session:", err)
+                    log.Println("wsServer error deleting old session:", err)
                 }
             }
         }
@@ -148,23 +206,56 @@ func websocket(dbpool *pgxpool.Pool) *socketio.Server {
     // serve websocket
     go func() {
         if err := wsServer.Serve(); err != nil {
-            log.Fatalf("wsServer socketio listen error: %s\n", err)
+            log.Printf("wsServer socketio listen error: %s\n", err)
         }
     }()
 
-    return wsServer
+    return wsServer, listener
+}
+
+func websocketDetach(listener *eventListener) func(w http.ResponseWriter, req *http.Request) {
+    return func(w http.ResponseWriter, req *http.Request) {
+        // /_socket/detach/${sessionId}
+        s := strings.SplitN(req.URL.Path, "/", 4)
+        if len(s) < 4 || s[3] == "" {
+            http.Error(w, "Expected /_socket/detach/{sessionId}", http.StatusNotFound)
+            return
+        }
+        sessionId := s[3]
+        log.Println("wsServer detaching", redactSessionID(sessionId))
+
+        w.Header().Set("Content-Type", "text/plain")
+        w.WriteHeader(200)
+        io.WriteString(w, "")
+
+        socketsMu.Lock()
+        delete(sockets, sessionId)
+        socketsMu.Unlock()
+        listener.send(listener.unlisten, sessionId)
+    }
 }
 
-func websocketDetach(w http.ResponseWriter, req *http.Request) {
-    // /_socket/detach/${sessionId}
-    s := strings.SplitN(req.URL.Path, "/", 4)
-    sessionId := s[3]
-    log.Println("wsServer detaching", sessionId)
+// closeWebsockets detaches every socket.io session, closes the socket.io
+// server and waits (up to ctx's deadline) for its listener's LISTEN goroutine
+// to give its connection back to the pool.  The sessions' events stay queued in
+// event.event for when the clients reattach.
+func closeWebsockets(ctx context.Context, wsServer *socketio.Server, listener *eventListener) {
+    socketsMu.Lock()
+    for sessionId, s := range sockets {
+        log.Println("wsServer detaching", redactSessionID(sessionId))
+        s.Close()
+        delete(sockets, sessionId)
+    }
+    socketsMu.Unlock()
 
-    w.Header().Set("Content-Type", "text/plain")
-    w.WriteHeader(200)
-    io.WriteString(w, "")
+    if err := wsServer.Close(); err != nil {
+        log.Println("wsServer close error:", err)
+    }
 
-    delete(sockets, sessionId)
-    unlisten <- sessionId
+    close(listener.stop)
+    select {
+    case <-listener.done:
+    case <-ctx.Done():
+        log.Println("wsServer LISTEN connection did not stop in time")
+    }
 }
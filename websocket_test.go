@@ -0,0 +1,23 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestEventListenerRunning(t *testing.T) {
+    var none *eventListener
+    if none.running() {
+        t.Error("nil listener running")
+    }
+
+    // a restart's listener is separate from the one it replaced
+    old := &eventListener{stop: make(chan bool), done: make(chan bool)}
+    current := &eventListener{stop: make(chan bool), done: make(chan bool)}
+    close(old.done)
+    if old.running() {
+        t.Error("stopped listener running")
+    }
+    if !current.running() {
+        t.Error("new listener stopped along with the old one")
+    }
+}